@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCacheSaveLoad(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "cache.gob")
+	rr, _ := dns.NewRR("host.test. 3600 IN AAAA 300:dada:feda:f123:ff:0:a00:1")
+
+	cache := New(time.Minute, 0)
+	cache.Set("host.test.", rrSet{rr}, 0)
+	cache.Set("expired.test.", rrSet{rr}, time.Millisecond)
+	soa, _ := dns.NewRR("test. 60 IN SOA ns.test. admin.test. 1 7200 3600 1209600 60")
+	cache.Set("/nx.test. IN TXT", cachedResponse{Rcode: dns.RcodeNameError, Ns: rrSet{soa}}, 0)
+	time.Sleep(5 * time.Millisecond)
+	if err := cache.SaveFile(fileName); err != nil {
+		t.Fatalf("SaveFile() error = %v", err)
+	}
+
+	loaded := New(time.Minute, 0)
+	if err := loaded.LoadFile(fileName); err != nil {
+		t.Fatalf("LoadFile() error = %v", err)
+	}
+	if loaded.ItemCount() != 2 {
+		t.Errorf("LoadFile() loaded %d items, want 2 without the expired one", loaded.ItemCount())
+	}
+	cached, found := loaded.Get("host.test.")
+	if !found {
+		t.Fatalf("Saved record is not loaded")
+	}
+	answer := cached.(rrSet)
+	if len(answer) != 1 || answer[0].String() != rr.String() {
+		t.Errorf("Loaded records = %v, want %v", answer, rr)
+	}
+	cached, _ = loaded.Get("/nx.test. IN TXT")
+	if response, ok := cached.(cachedResponse); !ok || response.Rcode != dns.RcodeNameError || len(response.Ns) != 1 {
+		t.Errorf("Loaded response = %+v", cached)
+	}
+}
+
+type sizedValue int
+
+func (v sizedValue) Size() int {
+	return int(v)
+}
+
+func TestCacheLRU(t *testing.T) {
+	cache := NewBounded(time.Minute, 0, 3, 0)
+	for _, k := range []string{"a", "b", "c"} {
+		cache.Set(k, k, 0)
+	}
+	// "a" is used, so "b" is the least recently used one
+	if _, found := cache.Get("a"); !found {
+		t.Fatalf("Get(a) found nothing")
+	}
+	cache.Set("d", "d", 0)
+	if _, found := cache.Get("b"); found {
+		t.Errorf("Least recently used item is not evicted")
+	}
+	for _, k := range []string{"a", "c", "d"} {
+		if _, found := cache.Get(k); !found {
+			t.Errorf("Get(%s) found nothing", k)
+		}
+	}
+	if cache.ItemCount() != 3 || cache.Evictions() != 1 {
+		t.Errorf("ItemCount() = %d, Evictions() = %d, want 3 and 1", cache.ItemCount(), cache.Evictions())
+	}
+
+	// Replaced item is not an eviction
+	cache.Set("a", "a2", 0)
+	if v, _ := cache.Get("a"); v != "a2" || cache.Evictions() != 1 {
+		t.Errorf("Get(a) = %v with %d evictions after replacing", v, cache.Evictions())
+	}
+}
+
+func TestCacheCopyTo(t *testing.T) {
+	cache := NewBounded(time.Minute, 0, 4, 0)
+	for _, k := range []string{"a", "b", "c"} {
+		cache.Set(k, k, 0)
+	}
+	cache.Set("expired", "expired", time.Nanosecond)
+	cache.Get("a")
+
+	// "b" is the least recently used one, it doesn't fit
+	smaller := NewBounded(time.Minute, 0, 2, 0)
+	cache.CopyTo(smaller)
+	if _, found := smaller.Get("b"); found {
+		t.Errorf("Least recently used item is copied over the limit")
+	}
+	for _, k := range []string{"a", "c"} {
+		if v, found := smaller.Get(k); !found || v != k {
+			t.Errorf("Get(%s) = %v, %v after copy", k, v, found)
+		}
+	}
+	if _, found := smaller.Get("expired"); found || smaller.ItemCount() != 2 {
+		t.Errorf("ItemCount() = %d after copy, want 2 without expired item", smaller.ItemCount())
+	}
+	if maxItems, maxBytes := smaller.Limits(); maxItems != 2 || maxBytes != 0 {
+		t.Errorf("Limits() = %d, %d, want 2, 0", maxItems, maxBytes)
+	}
+}
+
+func TestCacheBytes(t *testing.T) {
+	// Limit is split between 16 shards, 200 bytes each
+	cache := NewBounded(time.Minute, 0, 0, 3200)
+	for i := 0; i < 1000; i++ {
+		cache.Set(fmt.Sprintf("key%03d", i), sizedValue(94), 0)
+	}
+	if bytes := cache.Bytes(); bytes > 3200 || bytes == 0 {
+		t.Errorf("Bytes() = %d, want up to 3200", bytes)
+	}
+	if cache.Evictions() == 0 {
+		t.Errorf("Nothing is evicted")
+	}
+
+	// Item larger than the limit is not kept
+	cache.Set("huge", sizedValue(100000), 0)
+	if _, found := cache.Get("huge"); found {
+		t.Errorf("Item larger than the cache is kept")
+	}
+
+	cache.Flush()
+	if cache.ItemCount() != 0 || cache.Bytes() != 0 {
+		t.Errorf("ItemCount() = %d, Bytes() = %d after Flush()", cache.ItemCount(), cache.Bytes())
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	const limit = 1000
+	cache := NewBounded(time.Minute, 0, limit, 0)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// Random subdomains of a flood
+			for i := 0; i < 2000; i++ {
+				k := fmt.Sprintf("%d.%d.flood.test.", w, i)
+				cache.Set(k, i, 0)
+				cache.Get(k)
+				cache.Get("popular.test.")
+			}
+		}(w)
+	}
+	wg.Wait()
+	// Limit is split between shards evenly, rounded up
+	if n := cache.ItemCount(); n > limit+maxCacheShards {
+		t.Errorf("ItemCount() = %d, want about %d", n, limit)
+	}
+	if cache.Evictions() == 0 {
+		t.Errorf("Nothing is evicted")
+	}
+
+	cache.Set("short.test.", 1, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	cache.DeleteExpired()
+	if _, found := cache.Items()["short.test."]; found {
+		t.Errorf("Expired item is not deleted")
+	}
+}
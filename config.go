@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	"net"
 	"os"
 	"strings"
 	"time"
@@ -20,23 +19,113 @@ const (
 )
 
 type ZoneConfig struct {
-	Domains          []string `yaml:"domains"`
-	Prefix           net.IP   `yaml:"prefix,omitempty"`
-	ReturnPublicIPv4 bool     `yaml:"return-public-ipv4"`
+	Domains          []string      `yaml:"domains"`
+	DomainsFiles     stringList    `yaml:"domains-file"`
+	DomainsURLs      stringList    `yaml:"domains-url"`
+	Prefix           NAT64Prefixes `yaml:"prefix,omitempty"`
+	PrefixSelect     PrefixSelect  `yaml:"prefix-select"`
+	ReturnPublicIPv4 bool          `yaml:"return-public-ipv4"`
+	ReturnPublicIPv6 bool          `yaml:"return-public-ipv6"`
+}
+
+// List of strings, a single string is accepted as well
+type stringList []string
+
+// Zone config with its name. Zones keep the order of the config file
+type Zone struct {
+	Name string
+	ZoneConfig
+}
+
+type Zones []Zone
+
+// Upstream server. Address is "host:port" for plain DNS, "tls://host:853" for DNS-over-TLS
+// or "https://host/dns-query" for DNS-over-HTTPS
+type UpstreamConfig struct {
+	Address            string `yaml:"address"`
+	ServerName         string `yaml:"server-name"`
+	CAFile             string `yaml:"ca-file"`
+	InsecureSkipVerify bool   `yaml:"insecure-skip-verify"`
+	Bootstrap          string `yaml:"bootstrap"`
+	Method             string `yaml:"method"`
+}
+
+// Forwarder upstream servers and how to choose between them
+type ForwarderConfig struct {
+	Upstreams     []UpstreamConfig `yaml:"upstreams"`
+	Policy        Policy           `yaml:"policy"`
+	Timeout       time.Duration    `yaml:"timeout"`
+	MaxFails      int              `yaml:"max-fails"`
+	CheckInterval time.Duration    `yaml:"check-interval"`
+	Race          int              `yaml:"race"`
+	ParallelAAAA  bool             `yaml:"parallel-aaaa"`
+}
+
+type ListenerConfig struct {
+	Address  string   `yaml:"address"`
+	Protocol string   `yaml:"protocol"`
+	Cert     string   `yaml:"cert"`
+	Key      string   `yaml:"key"`
+	Path     string   `yaml:"path"`
+	Allow    []string `yaml:"allow"`
+}
+
+type Listeners []ListenerConfig
+
+// Cache timers. Expiration and purge are in minutes
+type CacheConfig struct {
+	ExpTime        time.Duration `yaml:"expiration"`
+	PurgeTime      time.Duration `yaml:"purge"`
+	MaxItems       int           `yaml:"max-items"`
+	MaxBytes       int64         `yaml:"max-bytes"`
+	MinTTL         time.Duration `yaml:"min-ttl"`
+	MaxTTL         time.Duration `yaml:"max-ttl"`
+	NegativeMaxTTL time.Duration `yaml:"negative-max-ttl"`
+	StaleTTL       time.Duration `yaml:"stale-ttl"`
+	StaleAnswerTTL time.Duration `yaml:"stale-answer-ttl"`
+	Prefetch       int           `yaml:"prefetch"`
+	Bypass         bool          `yaml:"bypass"`
+	KeepOnReload   bool          `yaml:"keep-on-reload"`
+	File           string        `yaml:"file"`
+}
+
+// Cache is bounded unless max-items is set to 0, so random names can't take all memory
+const defaultCacheItems = 100000
+
+// RFC 2308 recommends caching negative answers for 1-3 hours at most
+const defaultNegativeMaxTTL = 3 * time.Hour
+
+// RFC 8767 recommends serving stale records with 30 seconds TTL
+const defaultStaleAnswerTTL = 30 * time.Second
+
+// Longest time answers are cached. Expiration is the limit unless max-ttl is set,
+// zero means record TTLs are not limited
+func (c CacheConfig) maxTTL() time.Duration {
+	if c.MaxTTL > 0 {
+		return c.MaxTTL
+	}
+	return c.ExpTime * time.Minute
 }
 
 type Config struct {
-	Listen     string                `yaml:"listen"`
-	Zones      map[string]ZoneConfig `yaml:"zones"`
-	Forwarders map[string]string     `yaml:"forwarders"`
-	Default    string                `yaml:"default"`
-	IA         InvalidAddress        `yaml:"invalid-address"`
-	Static     map[string]string     `yaml:"static"`
-	Cache      struct {
-		ExpTime   time.Duration `yaml:"expiration"`
-		PurgeTime time.Duration `yaml:"purge"`
-	} `yaml:"cache"`
-	LogLevel string `yaml:"log-level"`
+	Listen          Listeners                  `yaml:"listen"`
+	Zones           Zones                      `yaml:"zones"`
+	Forwarders      map[string]ForwarderConfig `yaml:"forwarders"`
+	Default         ForwarderConfig            `yaml:"default"`
+	IA              InvalidAddress             `yaml:"invalid-address"`
+	Static          map[string]string          `yaml:"static"`
+	Views           Views                      `yaml:"views"`
+	UDPSize         uint16                     `yaml:"edns-buffer-size"`
+	Cache           CacheConfig                `yaml:"cache"`
+	LogLevel        string                     `yaml:"log-level"`
+	Metrics         string                     `yaml:"metrics"`
+	ShutdownTimeout time.Duration              `yaml:"shutdown-timeout"`
+	WatchInterval   time.Duration              `yaml:"watch-interval"`
+	RemoteLists     struct {
+		Dir     string        `yaml:"dir"`
+		Refresh time.Duration `yaml:"refresh"`
+		Timeout time.Duration `yaml:"timeout"`
+	} `yaml:"remote-lists"`
 }
 
 func (a InvalidAddress) String() string {
@@ -73,11 +162,165 @@ func (ia *InvalidAddress) UnmarshalYAML(unmarshal func(interface{}) error) (err
 	return nil
 }
 
+func (p Policy) String() string {
+	switch p {
+	case FailoverPolicy:
+		return "failover"
+	case RoundRobinPolicy:
+		return "round-robin"
+	case FastestPolicy:
+		return "fastest"
+	}
+	return "failover"
+}
+
+func (p *Policy) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var policy string
+
+	err = unmarshal(&policy)
+	if err != nil {
+		return
+	}
+
+	switch strings.ToLower(policy) {
+	case "failover":
+		*p = FailoverPolicy
+	case "round-robin":
+		*p = RoundRobinPolicy
+	case "fastest":
+		*p = FastestPolicy
+	default:
+		return fmt.Errorf("policy must be one of 'failover/round-robin/fastest'")
+	}
+
+	return nil
+}
+
+// Upstream accepts an address or the full config
+func (u *UpstreamConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var address string
+	if err := unmarshal(&address); err == nil {
+		*u = UpstreamConfig{Address: address}
+		return nil
+	}
+
+	type plain UpstreamConfig
+	return unmarshal((*plain)(u))
+}
+
+// Forwarder accepts a single upstream, a list of them, or the full config
+func (f *ForwarderConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var address string
+	if err := unmarshal(&address); err == nil {
+		*f = ForwarderConfig{Upstreams: []UpstreamConfig{{Address: address}}}
+		return nil
+	}
+	var upstreams []UpstreamConfig
+	if err := unmarshal(&upstreams); err == nil {
+		*f = ForwarderConfig{Upstreams: upstreams}
+		return nil
+	}
+
+	type plain ForwarderConfig
+	return unmarshal((*plain)(f))
+}
+
+// Get zone config by name
+func (z Zones) Get(name string) ZoneConfig {
+	for _, zone := range z {
+		if zone.Name == name {
+			return zone.ZoneConfig
+		}
+	}
+	return ZoneConfig{}
+}
+
+// Zones are decoded in the order they are listed in the config
+func (z *Zones) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var order yaml.MapSlice
+	if err := unmarshal(&order); err != nil {
+		return err
+	}
+	var configs map[string]ZoneConfig
+	if err := unmarshal(&configs); err != nil {
+		return err
+	}
+
+	*z = make(Zones, 0, len(order))
+	for _, item := range order {
+		name := fmt.Sprint(item.Key)
+		*z = append(*z, Zone{Name: name, ZoneConfig: configs[name]})
+	}
+	return nil
+}
+
+func (l ListenerConfig) String() string {
+	return l.Protocol + "://" + l.Address
+}
+
+func (l *ListenerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var address string
+	if err := unmarshal(&address); err == nil {
+		*l = ListenerConfig{Address: address}
+		return nil
+	}
+
+	// Protocol and certificate are checked by validation
+	type plain ListenerConfig
+	if err := unmarshal((*plain)(l)); err != nil {
+		return err
+	}
+	l.Protocol = strings.ToLower(l.Protocol)
+	return nil
+}
+
+// Listen accepts a single address, or a list of addresses and listeners.
+// An address without protocol is served over both UDP and TCP.
+func (l *Listeners) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []ListenerConfig
+	var single ListenerConfig
+	if err := unmarshal(&single); err == nil {
+		list = []ListenerConfig{single}
+	} else if err := unmarshal(&list); err != nil {
+		return err
+	}
+
+	*l = make(Listeners, 0, len(list))
+	for _, listener := range list {
+		if listener.Protocol == "" {
+			udp, tcp := listener, listener
+			udp.Protocol, tcp.Protocol = "udp", "tcp"
+			*l = append(*l, udp, tcp)
+			continue
+		}
+		*l = append(*l, listener)
+	}
+	return nil
+}
+
+func (l *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*l = stringList{single}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+var (
+	configFile = flag.String("file", "config.yml", "config filename")
+	checkOnly  = flag.Bool("check", false, "validate config file and exit")
+)
+
 func InitConfig() (Config, error) {
-	fileName := flag.String("file", "config.yml", "config filename")
 	flag.Parse()
 
-	Configs, err := parseFile(*fileName)
+	Configs, err := parseFile(*configFile)
 	if err != nil {
 		return Config{}, err
 	}
@@ -94,12 +337,15 @@ func parseFile(filePath string) (*Config, error) {
 	cfg.Cache.ExpTime = 0
 	cfg.Cache.PurgeTime = 0
 	cfg.LogLevel = "info"
-	if err := yaml.Unmarshal(body, &cfg); err != nil {
+	cfg.UDPSize = 1232
+	cfg.ShutdownTimeout = 5 * time.Second
+	cfg.WatchInterval = 10 * time.Second
+	cfg.Cache.NegativeMaxTTL = defaultNegativeMaxTTL
+	cfg.Cache.MaxItems = defaultCacheItems
+	// Unknown keys are errors, so misspelled settings aren't silently ignored
+	if err := yaml.UnmarshalStrict(body, &cfg); err != nil {
 		return nil, err
 	}
 
 	return cfg, nil
 }
-
-// func (c *Config) validateForwarders() {
-// }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseListeners(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		expected Listeners
+	}{
+		{
+			"Single address",
+			`listen: "[::1]:53"`,
+			Listeners{{Address: "[::1]:53", Protocol: "udp"}, {Address: "[::1]:53", Protocol: "tcp"}},
+		},
+		{
+			"List of addresses",
+			"listen:\n  - \"[::1]:53\"\n  - \"127.0.0.1:53\"",
+			Listeners{{Address: "[::1]:53", Protocol: "udp"}, {Address: "[::1]:53", Protocol: "tcp"}, {Address: "127.0.0.1:53", Protocol: "udp"}, {Address: "127.0.0.1:53", Protocol: "tcp"}},
+		},
+		{
+			"Listeners with protocol",
+			"listen:\n  - address: \"[::1]:53\"\n    protocol: UDP\n  - address: \"127.0.0.1:5353\"\n    protocol: tcp",
+			Listeners{{Address: "[::1]:53", Protocol: "udp"}, {Address: "127.0.0.1:5353", Protocol: "tcp"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Config
+			if err := yaml.Unmarshal([]byte(tt.yaml), &cfg); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if !reflect.DeepEqual(cfg.Listen, tt.expected) {
+				t.Errorf("Listen = %v, want %v", cfg.Listen, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseUnknownKeys(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "config.yml")
+	body := "zones:\n  default:\n    domains: [\".\"]\nchache:\n  min-ttl: 1m\n"
+	if err := os.WriteFile(fileName, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseFile(fileName); err == nil || !strings.Contains(err.Error(), "chache") {
+		t.Errorf("parseFile() with unknown key error = %v, want error about chache", err)
+	}
+}
+
+func TestParseZonesOrder(t *testing.T) {
+	body := `
+zones:
+  zone2:
+    domains: ["com"]
+  default:
+    domains: ["."]
+    prefix: "300:dada:feda:f123:ff::"
+  zone1:
+    domains: ["com.tr"]
+    domains-file: "/etc/yggdns64/direct.txt"
+    return-public-ipv4: true
+  zone3:
+    domains-file: ["a.txt", "b.txt"]
+    prefix: ["300:dada:feda:f123:ff::", "300:baba:feda:f123::/64"]
+    prefix-select: hash-client
+`
+	var cfg Config
+	if err := yaml.Unmarshal([]byte(body), &cfg); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+
+	names := make([]string, 0, len(cfg.Zones))
+	for _, zone := range cfg.Zones {
+		names = append(names, zone.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"zone2", "default", "zone1", "zone3"}) {
+		t.Errorf("Zones order = %v, want [zone2 default zone1 zone3]", names)
+	}
+	if !cfg.Zones.Get("zone1").ReturnPublicIPv4 || !cfg.Zones.Get("default").Prefix.IsSet() {
+		t.Errorf("Zones config is not decoded: %+v", cfg.Zones)
+	}
+	if !reflect.DeepEqual(cfg.Zones.Get("zone1").DomainsFiles, stringList{"/etc/yggdns64/direct.txt"}) ||
+		!reflect.DeepEqual(cfg.Zones.Get("zone3").DomainsFiles, stringList{"a.txt", "b.txt"}) {
+		t.Errorf("Domains files are not decoded: %+v", cfg.Zones)
+	}
+	if zone3 := cfg.Zones.Get("zone3"); len(zone3.Prefix) != 2 || zone3.Prefix[1].Bits() != 64 || zone3.PrefixSelect != HashClientPrefix {
+		t.Errorf("Prefixes are not decoded: %+v", zone3)
+	}
+	if err := yaml.Unmarshal([]byte("zones:\n  default:\n    prefix-select: random"), &cfg); err == nil {
+		t.Errorf("Unmarshal() with unknown prefix-select succeeded")
+	}
+}
+
+func TestParseForwarders(t *testing.T) {
+	body := `
+forwarders:
+  ".ygg":
+    upstreams: ["[308:84:68:55::]:53", "[308:25:40:bd::]:53"]
+    policy: round-robin
+    timeout: 500ms
+  ".local": "192.168.3.1:53"
+default: ["8.8.8.8:53", "1.1.1.1:53"]
+`
+	var cfg Config
+	if err := yaml.Unmarshal([]byte(body), &cfg); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+
+	expected := map[string]ForwarderConfig{
+		".ygg": {
+			Upstreams: []UpstreamConfig{{Address: "[308:84:68:55::]:53"}, {Address: "[308:25:40:bd::]:53"}},
+			Policy:    RoundRobinPolicy,
+			Timeout:   500 * time.Millisecond,
+		},
+		".local": {Upstreams: []UpstreamConfig{{Address: "192.168.3.1:53"}}},
+	}
+	if !reflect.DeepEqual(cfg.Forwarders, expected) {
+		t.Errorf("Forwarders = %+v, want %+v", cfg.Forwarders, expected)
+	}
+	if !reflect.DeepEqual(cfg.Default, ForwarderConfig{Upstreams: []UpstreamConfig{{Address: "8.8.8.8:53"}, {Address: "1.1.1.1:53"}}}) {
+		t.Errorf("Default = %+v", cfg.Default)
+	}
+
+	if err := yaml.Unmarshal([]byte("default:\n  upstreams: [\"8.8.8.8:53\"]\n  policy: random"), &cfg); err == nil {
+		t.Errorf("Unmarshal() with unknown policy succeeded")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg, err := parseFile("config.yml")
+	if err != nil {
+		t.Fatalf("parseFile() error = %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() of the sample config error = %v", err)
+	}
+
+	body := `
+listen:
+  - "127.0.0.1"
+  - "[::1]:53"
+  - address: ":53"
+    protocol: sctp
+  - address: ":853"
+    protocol: dot
+zones:
+  default:
+    domains: ["example.com", "exa mple.com"]
+    prefix: "300:dada:feda:f123:ff::1"
+  ipv4:
+    domains: ["ipv4.test"]
+    prefix: "10.0.0.0/8"
+  other:
+    domains: ["."]
+    prefix: "2001:db8::/80"
+forwarders:
+  ".ygg":
+    upstreams: ["[308:84:68:55::]", "tls://dns.quad9.net", "https://"]
+  ".local": "192.168.3.1:53"
+default:
+  - address: "tls://1.1.1.1:853"
+    bootstrap: "one.one"
+static:
+  "test.com": "8.8.8.8"
+  "test2.com": "2001:db8::1"
+views:
+  lan:
+    clients: ["192.168.0.0/33"]
+    zones:
+      default:
+        domains: ["."]
+        prefix: ["300:dada:feda:f123:ff::", "2001:db8::/80"]
+    static:
+      "test3.com": "ten.zero.zero.one"
+  empty: {}
+  office:
+    clients: ["10.0.0.0/8"]
+    zones:
+      office:
+        domains: ["office.test"]
+cache:
+  min-ttl: 2h
+  max-ttl: 1h
+  stale-ttl: -1h
+log-level: trace
+metrics: "localhost"
+`
+	cfg = new(Config)
+	cfg.UDPSize = 1232
+	if err := yaml.Unmarshal([]byte(body), cfg); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	expected := []string{
+		`listen[0]: address 127.0.0.1: missing port in address`,
+		`listen[4].protocol: "sctp" must be one of 'udp/tcp/dot/doh'`,
+		`listen[5]: dot listener needs cert and key`,
+		`zones.default.domains[1]: invalid domain name "exa mple.com"`,
+		`zones.default.prefix: 300:dada:feda:f123:ff::1/96 has bits set after the prefix length`,
+		`zones.ipv4.prefix: not an IPv6 prefix`,
+		`zones.other.prefix: length of 2001:db8::/80 must be one of 32, 40, 48, 56, 64 or 96`,
+		`default.upstreams[0]: bootstrap "one.one" is not an IP address`,
+		`forwarders[".ygg"].upstreams[0]: address [308:84:68:55::]: missing port in address`,
+		`forwarders[".ygg"].upstreams[2]: no host in "https://"`,
+		`static["test2.com"]: "2001:db8::1" is not an IPv4 address`,
+		`views.lan.clients: invalid CIDR address: 192.168.0.0/33`,
+		`views.lan.zones.default.prefix[1]: length of 2001:db8::/80 must be one of 32, 40, 48, 56, 64 or 96`,
+		`views.lan.static["test3.com"]: "ten.zero.zero.one" is not an IPv4 address`,
+		`views.empty.clients: no client networks`,
+		`views.office.zones: no zone has "." domain for names outside of other zones`,
+		`cache.stale-ttl: negative value -1h0m0s`,
+		`cache.min-ttl: 2h0m0s is more than the longest cache time 1h0m0s`,
+		`log-level: "trace" must be one of 'debug/info/err/none'`,
+		`metrics: address localhost: missing port in address`,
+	}
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatalf("Validate() of broken config succeeded")
+	}
+	if problems := strings.Split(err.Error(), "\n"); !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Validate() problems:\n%s\nwant:\n%s", strings.Join(problems, "\n"), strings.Join(expected, "\n"))
+	}
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"net"
+	"net/netip"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 
@@ -13,16 +18,185 @@ import (
 
 var yggnet *net.IPNet
 
+// Documentation prefixes (RFC 3849, RFC 9637), never real addresses
+var ipv6DocNets = []netip.Prefix{netip.MustParsePrefix("2001:db8::/32"), netip.MustParsePrefix("3fff::/20")}
+
+// Address return-public-ipv6 passes: global unicast, not unique local or documentation one
+func publicIPv6(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	for _, prefix := range ipv6DocNets {
+		if prefix.Contains(addr.Unmap()) {
+			return false
+		}
+	}
+	return true
+}
+
+// EDNS0 UDP buffer size advertised to upstream servers and clients
+var ednsUDPSize uint16 = 1232
+
+// TTL of records synthesized for static addresses
+const staticTTL = 3600
+
 type DNSProxy struct {
-	Cache          *Cache
-	static         map[string]string
-	forwarders     map[string]string
-	defaultForward string
-	ia             InvalidAddress
-	zones          map[string]ZoneConfig
+	Cache              *Cache
+	static             map[string]string
+	forwarders         *domainTree[*Forwarder]
+	defaultForward     *Forwarder
+	ia                 InvalidAddress
+	zones              Zones
+	zoneIDs            *atomic.Pointer[domainTree[string]] // Replaced when domains files change, shared with views of the same zones
+	zoneFiles          []fileState                         // Files zoneIDs is built from
+	zonesMu            sync.Mutex                          // Serializes zoneIDs rebuilds
+	listsDir           string
+	minTTL             time.Duration // Bounds of cached answers TTL
+	maxTTL             time.Duration
+	negativeMaxTTL     time.Duration        // Cap of NXDOMAIN and NODATA answers TTL
+	staleTTL           time.Duration        // Expired answers are kept this long for upstream failures
+	staleAnswerTTL     time.Duration        // TTL of stale records
+	staleAnswerTimeout time.Duration        // Upstream is waited this long before stale records are served
+	prefetchHits       int64                // Answers served this many times are refreshed before expiring
+	prefetchQueue      chan prefetchRequest // Nil unless prefetching is on
+	noCache            bool                 // Cache is bypassed
+	active             sync.RWMutex         // Held for reading by queries in flight
+	logger             *Log
+	view               string       // Name of the view, empty at the top level
+	views              []clientView // Views clients are routed to
+	stop               chan struct{}
+	stopOnce           sync.Once
+}
+
+func NewDNSProxy(cfg Config, cache *Cache) (*DNSProxy, error) {
+	proxy := newProxy(cfg, cache)
+	if len(cfg.Default.Upstreams) > 0 {
+		forwarder, err := NewForwarder(cfg.Default)
+		if err != nil {
+			return nil, fmt.Errorf("default forwarder: %w", err)
+		}
+		proxy.defaultForward = forwarder
+	}
+	forwarders, err := newForwarders(cfg.Forwarders)
+	if err != nil {
+		proxy.Close()
+		return nil, err
+	}
+	proxy.forwarders = forwarders
+	if err := proxy.initZones(cfg); err != nil {
+		proxy.Close()
+		return nil, err
+	}
+	if proxy.prefetchHits > 0 && proxy.cacheEnabled() {
+		proxy.prefetchQueue = make(chan prefetchRequest, prefetchQueueSize)
+		go proxy.prefetchWorker()
+	}
+	if err := proxy.initViews(cfg); err != nil {
+		proxy.Close()
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// Proxy with cache settings of cfg, without forwarders and zones
+func newProxy(cfg Config, cache *Cache) *DNSProxy {
+	proxy := &DNSProxy{
+		Cache:              cache,
+		static:             cfg.Static,
+		forwarders:         newDomainTree[*Forwarder](),
+		ia:                 cfg.IA,
+		zones:              cfg.Zones,
+		zoneIDs:            new(atomic.Pointer[domainTree[string]]),
+		listsDir:           cfg.RemoteLists.Dir,
+		minTTL:             cfg.Cache.MinTTL,
+		maxTTL:             cfg.Cache.maxTTL(),
+		negativeMaxTTL:     cfg.Cache.NegativeMaxTTL,
+		staleTTL:           cfg.Cache.StaleTTL,
+		staleAnswerTTL:     cfg.Cache.StaleAnswerTTL,
+		staleAnswerTimeout: staleAnswerTimeout,
+		prefetchHits:       int64(cfg.Cache.Prefetch),
+		noCache:            cfg.Cache.Bypass,
+		logger:             NewLogger(cfg.LogLevel),
+		stop:               make(chan struct{}),
+	}
+	if proxy.staleAnswerTTL <= 0 {
+		proxy.staleAnswerTTL = defaultStaleAnswerTTL
+	}
+	return proxy
+}
+
+// Forwarders of domains. Already created ones are closed on errors.
+func newForwarders(configs map[string]ForwarderConfig) (*domainTree[*Forwarder], error) {
+	forwarders := newDomainTree[*Forwarder]()
+	for domain, fcfg := range configs {
+		forwarder, err := NewForwarder(fcfg)
+		if err != nil {
+			forwarders.Walk(func(forwarder *Forwarder) {
+				forwarder.Close()
+			})
+			return nil, fmt.Errorf("forwarder %s: %w", domain, err)
+		}
+		forwarders.Insert(domain, forwarder)
+	}
+	return forwarders, nil
+}
+
+// Build zone tree, then watch domains files and refresh remote lists until the proxy is closed.
+// Hosts of the lists are resolved through the forwarders, so they are set up first.
+func (proxy *DNSProxy) initZones(cfg Config) error {
+	// Zones are built from the last copies of remote lists, fresh ones are downloaded in the background
+	if err := proxy.reloadZones(); err != nil {
+		return err
+	}
+	if len(proxy.zoneFiles) > 0 && cfg.WatchInterval > 0 {
+		go proxy.watchDomainsFiles(cfg.WatchInterval)
+	}
+	if len(listURLs(cfg.Zones)) > 0 {
+		timeout := cfg.RemoteLists.Timeout
+		if timeout <= 0 {
+			timeout = defaultListsTimeout
+		}
+		refresh := cfg.RemoteLists.Refresh
+		if refresh <= 0 {
+			refresh = defaultListsRefresh
+		}
+		go proxy.refreshLists(proxy.newListsClient(timeout), refresh)
+	}
+	return nil
+}
+
+// Close proxy once queries in flight are finished
+func (proxy *DNSProxy) CloseWhenIdle() {
+	go func() {
+		proxy.active.Lock()
+		defer proxy.active.Unlock()
+		proxy.Close()
+	}()
 }
 
-func (proxy *DNSProxy) getResponse(requestMsg *dns.Msg) (*dns.Msg, error) {
+// Stop forwarders health checks, domains files watching and prefetching.
+// Forwarders shared with views are stopped by whichever closes them first.
+func (proxy *DNSProxy) Close() {
+	proxy.stopOnce.Do(func() {
+		if proxy.stop != nil {
+			close(proxy.stop)
+		}
+	})
+	proxy.defaultForward.Close()
+	proxy.forwarders.Walk(func(forwarder *Forwarder) {
+		forwarder.Close()
+	})
+	for _, view := range proxy.views {
+		view.proxy.Close()
+	}
+}
+
+// Answer query of client. Client address chooses the view, and prefix of zones with hash-client prefix-select
+func (proxy *DNSProxy) getResponse(requestMsg *dns.Msg, client net.IP) (*dns.Msg, error) {
+	if view := proxy.forClient(client); view != proxy {
+		return view.getResponse(requestMsg, client)
+	}
 	responseMsg := new(dns.Msg)
 	var answer *dns.Msg
 	var err error
@@ -41,19 +215,21 @@ func (proxy *DNSProxy) getResponse(requestMsg *dns.Msg) (*dns.Msg, error) {
 
 		switch question.Qtype {
 		case dns.TypeA:
-			answer, err = proxy.processTypeA(dnsServer, lookup, &question, requestMsg, zoneID)
+			answer, err = proxy.processTypeA(dnsServer, &question, requestMsg, zoneID)
 		case dns.TypeAAAA:
-			answer, err = proxy.processTypeAAAA(dnsServer, &question, requestMsg, zoneID)
+			answer, err = proxy.processTypeAAAA(dnsServer, &question, requestMsg, zoneID, client)
 		case dns.TypePTR:
 			answer, err = proxy.processTypePTR(dnsServer, &question, requestMsg, zoneID)
 		case dns.TypeANY:
-			answer, err = proxy.processTypeANY(dnsServer, &question, requestMsg, zoneID)
+			answer, err = proxy.processTypeANY(dnsServer, &question, requestMsg, zoneID, client)
 		default:
 			answer, err = proxy.processOtherTypes(dnsServer, &question, requestMsg)
 		}
 	}
 
 	if err != nil {
+		// Client matches the reply by ID and question, a bare message would leave it waiting
+		responseMsg.SetRcode(requestMsg, dns.RcodeServerFailure)
 		return responseMsg, err
 	}
 
@@ -62,12 +238,12 @@ func (proxy *DNSProxy) getResponse(requestMsg *dns.Msg) (*dns.Msg, error) {
 	return answer, err
 }
 
-func (proxy *DNSProxy) processOtherTypes(dnsServer string, q *dns.Question, requestMsg *dns.Msg) (*dns.Msg, error) {
+func (proxy *DNSProxy) processOtherTypes(dnsServer *Forwarder, q *dns.Question, requestMsg *dns.Msg) (*dns.Msg, error) {
 	queryMsg := new(dns.Msg)
 	requestMsg.CopyTo(queryMsg)
 	queryMsg.Question = []dns.Question{*q}
 
-	msg, err := lookup(dnsServer, queryMsg)
+	msg, err := proxy.exchange(dnsServer, queryMsg)
 	if err != nil {
 		return nil, err
 	}
@@ -76,25 +252,25 @@ func (proxy *DNSProxy) processOtherTypes(dnsServer string, q *dns.Question, requ
 }
 
 // Query ANY
-func (proxy *DNSProxy) processTypeANY(dnsServer string, q *dns.Question, requestMsg *dns.Msg, zoneID string) (*dns.Msg, error) {
+func (proxy *DNSProxy) processTypeANY(dnsServer *Forwarder, q *dns.Question, requestMsg *dns.Msg, zoneID string, client net.IP) (*dns.Msg, error) {
 	queryMsg := new(dns.Msg)
 	requestMsg.CopyTo(queryMsg)
 	queryMsg.Question = []dns.Question{*q}
 
-	msg, err := lookup(dnsServer, queryMsg)
+	msg, err := proxy.exchange(dnsServer, queryMsg)
 	if err != nil {
 		return nil, err
 	}
 
 	// Recompile reply
-	msg.Answer = proxy.processAnswerArray(msg.Answer, zoneID)
-	msg.Extra = proxy.processAnswerArray(msg.Extra, zoneID)
+	msg.Answer = proxy.processAnswerArray(msg.Answer, zoneID, client)
+	msg.Extra = proxy.processAnswerArray(msg.Extra, zoneID, client)
 
 	return msg, nil
 }
 
 // process answer array
-func (proxy *DNSProxy) processAnswerArray(q []dns.RR, zoneID string) (answer []dns.RR) {
+func (proxy *DNSProxy) processAnswerArray(q []dns.RR, zoneID string, client net.IP) (answer []dns.RR) {
 	answer = make([]dns.RR, 0)
 	for _, orr := range q {
 		switch rr := orr.(type) {
@@ -112,6 +288,9 @@ func (proxy *DNSProxy) processAnswerArray(q []dns.RR, zoneID string) (answer []d
 				// if answer contains ygg address - return it
 				if yggnet.Contains(rr.AAAA) {
 					answer = append(answer, rr)
+				} else if proxy.zones.Get(zoneID).ReturnPublicIPv6 && publicIPv6(rr.AAAA) {
+					// return public ipv6
+					answer = append(answer, rr)
 				}
 			}
 		case *dns.A:
@@ -123,19 +302,16 @@ func (proxy *DNSProxy) processAnswerArray(q []dns.RR, zoneID string) (answer []d
 				case ProcessInvalidAddress: // return "[::]"
 					nrr, _ := dns.NewRR(rr.Hdr.Name + " IN AAAA ::")
 					answer = append(answer, nrr)
-					if proxy.zones[zoneID].ReturnPublicIPv4 {
+					if proxy.zones.Get(zoneID).ReturnPublicIPv4 {
 						answer = append(answer, rr)
 					}
 					continue
 				}
 			}
 			// return fake ip
-			if proxy.zones[zoneID].Prefix != nil {
-				nrr, _ := dns.NewRR(rr.Hdr.Name + " IN AAAA " + proxy.MakeFakeIP(rr.A, zoneID))
-				answer = append(answer, nrr)
-			}
+			answer = append(answer, proxy.fakeAAAA(rr.Hdr.Name, rr.A, rr.Hdr.Ttl, zoneID, client)...)
 			// return public ipv4
-			if proxy.zones[zoneID].ReturnPublicIPv4 {
+			if proxy.zones.Get(zoneID).ReturnPublicIPv4 {
 				answer = append(answer, rr)
 			}
 		default:
@@ -146,7 +322,7 @@ func (proxy *DNSProxy) processAnswerArray(q []dns.RR, zoneID string) (answer []d
 }
 
 // Query PTR
-func (proxy *DNSProxy) processTypePTR(dnsServer string, q *dns.Question, requestMsg *dns.Msg, zoneID string) (*dns.Msg, error) {
+func (proxy *DNSProxy) processTypePTR(dnsServer *Forwarder, q *dns.Question, requestMsg *dns.Msg, zoneID string) (*dns.Msg, error) {
 	queryMsg := new(dns.Msg)
 	requestMsg.CopyTo(queryMsg)
 	//    queryMsg.Question = []dns.Question{*q}
@@ -161,7 +337,7 @@ func (proxy *DNSProxy) processTypePTR(dnsServer string, q *dns.Question, request
 	q.Name, _ = dns.ReverseAddr(ip.String())
 	queryMsg.Question = []dns.Question{*q}
 
-	msg, err := lookup(dnsServer, queryMsg)
+	msg, err := proxy.exchange(dnsServer, queryMsg)
 	if err != nil {
 		return nil, err
 	}
@@ -181,163 +357,154 @@ func (proxy *DNSProxy) processTypePTR(dnsServer string, q *dns.Question, request
 }
 
 // Query A record.
-func (proxy *DNSProxy) processTypeA(dnsServer string, lookup LookupFunc, q *dns.Question, requestMsg *dns.Msg, zoneID string) (*dns.Msg, error) {
+func (proxy *DNSProxy) processTypeA(dnsServer *Forwarder, q *dns.Question, requestMsg *dns.Msg, zoneID string) (*dns.Msg, error) {
 	queryMsg := new(dns.Msg)
 	requestMsg.CopyTo(queryMsg)
 	queryMsg.Question = []dns.Question{*q}
-	msg, err := lookup(dnsServer, queryMsg)
+	msg, err := proxy.exchange(dnsServer, queryMsg)
 	if err != nil {
 		queryMsg.MsgHdr.Rcode = dns.RcodeServerFailure
 		queryMsg.MsgHdr.Opcode = dns.OpcodeNotify
 		return queryMsg, err
 	}
-	if !proxy.zones[zoneID].ReturnPublicIPv4 {
+	if !proxy.zones.Get(zoneID).ReturnPublicIPv4 {
 		// Emulate "no record" for existings A
 		msg.Answer = make([]dns.RR, 0)
 	}
 	return msg, nil
 }
 
-func (proxy *DNSProxy) processTypeAAAA(dnsServer string, q *dns.Question, requestMsg *dns.Msg, zoneID string) (msg *dns.Msg, err error) {
+func (proxy *DNSProxy) processTypeAAAA(dnsServer *Forwarder, q *dns.Question, requestMsg *dns.Msg, zoneID string, client net.IP) (msg *dns.Msg, err error) {
 	msg = new(dns.Msg)
-	cacheAnswer, found := proxy.Cache.Get(q.Name)
-
-	// Have cache record?
 
-	if !found {
+	// Upstream answers are cached, so the synthesized answer is built every time.
+	// Have static address?
 
-		// No cache.
-		// Have static address?
+	ip := proxy.getStatic(q.Name)
+	if ip != "" {
+		requestMsg.CopyTo(msg)
+		answer := append(make([]dns.RR, 0), proxy.fakeAAAA(q.Name, net.ParseIP(ip), staticTTL, zoneID, client)...)
+		msg.Answer = answer
+		msg.Question[0].Qtype = dns.TypeAAAA
+		msg.MsgHdr.Response = true
+		return msg, nil
+	}
 
-		ip := proxy.getStatic(q.Name)
-		if ip != "" {
-			requestMsg.CopyTo(msg)
-			answer := make([]dns.RR, 0)
-			if proxy.zones[zoneID].Prefix != nil {
-				rr, _ := dns.NewRR(q.Name + " IN AAAA " + proxy.MakeFakeIP(net.ParseIP(ip), zoneID))
-				answer = append(answer, rr)
-			}
-			msg.Answer = answer
-			msg.Question[0].Qtype = dns.TypeAAAA
-			msg.MsgHdr.Response = true
-			proxy.Cache.Set(q.Name, answer, 0)
-			return msg, nil
-		}
+	// No static.
+	// A query for the translation, sent together with AAAA if forwarder wants so
+
+	aQuestion := *q
+	aQuestion.Qtype = dns.TypeA
+	aQueryMsg := new(dns.Msg)
+	requestMsg.CopyTo(aQueryMsg)
+	aQueryMsg.Question = []dns.Question{aQuestion}
+
+	var aResult chan exchangeResult
+	if dnsServer.ParallelAAAA() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		aResult = make(chan exchangeResult, 1)
+		go func() {
+			r, err := proxy.exchangeContext(ctx, dnsServer, aQueryMsg)
+			aResult <- exchangeResult{r, err}
+		}()
+	}
 
-		// No static.
-		// Query AAAA address, may be it's already ygg?
+	// Query AAAA address, may be it's already ygg?
 
-		queryMsg := new(dns.Msg)
-		requestMsg.CopyTo(queryMsg)
-		queryMsg.Question = []dns.Question{*q}
+	queryMsg := new(dns.Msg)
+	requestMsg.CopyTo(queryMsg)
+	queryMsg.Question = []dns.Question{*q}
 
-		msg, err = lookup(dnsServer, queryMsg)
-		if err != nil {
-			return nil, err
-		}
+	var aaaaMsg *dns.Msg
+	aaaaMsg, err = proxy.exchange(dnsServer, queryMsg)
+	if err != nil {
+		return nil, err
+	}
 
-		answer := make([]dns.RR, 0)
+	// Ygg addresses go first, public ones are added after them if the zone wants so
+	answer := make([]dns.RR, 0)
+	public := make([]dns.RR, 0)
 
-		for _, orr := range msg.Answer {
-			a, okA := orr.(*dns.AAAA)
-			if okA {
-				if yggnet.Contains(a.AAAA) {
-					answer = append(answer, orr)
-				}
+	for _, orr := range aaaaMsg.Answer {
+		a, okA := orr.(*dns.AAAA)
+		if okA {
+			if yggnet.Contains(a.AAAA) {
+				answer = append(answer, orr)
+			} else if proxy.zones.Get(zoneID).ReturnPublicIPv6 && publicIPv6(a.AAAA) {
+				public = append(public, orr)
 			}
 		}
+	}
 
-		if len(answer) != 0 {
-			msg.Answer = answer
-			msg.MsgHdr.Response = true
-			proxy.Cache.Set(q.Name, answer, 0)
-			return msg, nil
-		}
+	if len(answer) != 0 {
+		answer = append(answer, public...)
+		aaaaMsg.Answer = answer
+		aaaaMsg.MsgHdr.Response = true
+		return aaaaMsg, nil
+	}
 
-		// No. Ok, query A address and translate to ygg.
+	// No. Ok, query A address and translate to ygg.
 
-		q.Qtype = dns.TypeA
-		queryMsg = new(dns.Msg)
-		requestMsg.CopyTo(queryMsg)
-		queryMsg.Question = []dns.Question{*q}
+	if aResult != nil {
+		result := <-aResult
+		msg, err = result.msg, result.err
+	} else {
+		msg, err = proxy.exchange(dnsServer, aQueryMsg)
+	}
+	if err != nil && len(public) == 0 {
+		return nil, err
+	}
+	if err != nil || len(public) > 0 && msg.Rcode != dns.RcodeSuccess {
+		// Public addresses are still an answer
+		msg, err = aaaaMsg, nil
+		msg.Answer = nil
+	}
 
-		msg, err = lookup(dnsServer, queryMsg)
-		if err != nil {
-			return nil, err
-		}
+	// Build fake answer
 
-		// Build fake answer
-
-		answer = make([]dns.RR, 0)
-		for _, orr := range msg.Answer {
-			a, okA := orr.(*dns.A)
-			if okA {
-				if a.A.IsUnspecified() {
-					switch proxy.ia {
-					case DiscardInvalidAddress: // drop
-						continue
-					case IgnoreInvalidAddress: // return "as-is"
-					case ProcessInvalidAddress: // return "[::]"
-						nrr, _ := dns.NewRR(q.Name + " IN AAAA ::")
-						answer = append(answer, nrr)
-						continue
-					}
-				}
-				if proxy.zones[zoneID].Prefix != nil {
-					rr, _ := dns.NewRR(q.Name + " IN AAAA " + proxy.MakeFakeIP(a.A, zoneID))
-					answer = append(answer, rr)
+	answer = make([]dns.RR, 0)
+	for _, orr := range msg.Answer {
+		a, okA := orr.(*dns.A)
+		if okA {
+			if a.A.IsUnspecified() {
+				switch proxy.ia {
+				case DiscardInvalidAddress: // drop
+					continue
+				case IgnoreInvalidAddress: // return "as-is"
+				case ProcessInvalidAddress: // return "[::]"
+					nrr, _ := dns.NewRR(q.Name + " IN AAAA ::")
+					answer = append(answer, nrr)
+					continue
 				}
 			}
+			answer = append(answer, proxy.fakeAAAA(q.Name, a.A, a.Hdr.Ttl, zoneID, client)...)
 		}
-		msg.Answer = answer
-		msg.Question[0].Qtype = dns.TypeAAAA
-
-		if len(answer) > 0 {
-			proxy.Cache.Set(q.Name, answer, 0)
-		}
-		return msg, nil
-	} else {
+	}
+	answer = append(answer, public...)
+	msg.Answer = answer
+	msg.Question[0].Qtype = dns.TypeAAAA
 
-		// We have cache record
+	return msg, nil
+}
 
-		requestMsg.CopyTo(msg)
-		msg.Answer = cacheAnswer.([]dns.RR)
-		msg.Question[0].Qtype = dns.TypeAAAA
-		msg.MsgHdr.Response = true
-		return msg, nil
-	}
+type exchangeResult struct {
+	msg *dns.Msg
+	err error
 }
 
-func (dnsProxy *DNSProxy) getForwarder(domain string) string {
-	for k, v := range dnsProxy.forwarders {
-		if strings.HasSuffix(strings.ToLower(domain), strings.ToLower(k+".")) {
-			return v
-		}
+func (dnsProxy *DNSProxy) getForwarder(domain string) *Forwarder {
+	if forwarder, found := dnsProxy.forwarders.Lookup(domain); found {
+		return forwarder
 	}
 	return dnsProxy.defaultForward
 }
 
 func (dnsProxy *DNSProxy) getZoneID(domain string) string {
-	//  Find zone id for the requested domain
-	for k, v := range dnsProxy.zones {
-		for _, ZoneDomain := range v.Domains {
-			if strings.EqualFold(domain, ZoneDomain+".") ||
-				strings.HasSuffix(strings.ToLower(domain), strings.ToLower("."+ZoneDomain+".")) {
-				return k
-			}
-		}
-	}
-	//  Else find default zone with .
-	for k, v := range dnsProxy.zones {
-		for _, ZoneDomain := range v.Domains {
-			if ZoneDomain == "." {
-				return k
-			}
-		}
-	}
-	// No zone found
-	// log.Fatal("Failed to find zone for " + domain + ". Probably no zones with '.' domain.")
-	return ""
+	//  Find zone of the most specific domain, "." matches everything.
+	//  No zone found returns ""
+	zoneID, _ := dnsProxy.zoneIDs.Load().Lookup(domain)
+	return zoneID
 }
 
 func (dnsProxy *DNSProxy) getStatic(domain string) string {
@@ -362,33 +529,110 @@ func GetOutboundIP() (net.IP, error) {
 	return localAddr.IP, nil
 }
 
-type LookupFunc func(string, *dns.Msg) (*dns.Msg, error)
-
+// Query server over UDP advertising ednsUDPSize buffer.
+// Truncated answers are retried over TCP.
 func lookup(server string, m *dns.Msg) (*dns.Msg, error) {
-	dnsClient := new(dns.Client)
-	dnsClient.Net = "udp"
-	response, _, err := dnsClient.Exchange(m, server)
+	return lookupContext(context.Background(), server, m)
+}
+
+// Same as lookup, aborting the query when ctx is done
+func lookupContext(ctx context.Context, server string, m *dns.Msg) (*dns.Msg, error) {
+	queryMsg := m.Copy()
+	setEDNS0(queryMsg, ednsUDPSize)
+
+	response, err := exchangeContext(ctx, "udp", server, queryMsg)
 	if err != nil {
 		return nil, err
 	}
 
+	if response.Truncated {
+		response, err = exchangeContext(ctx, "tcp", server, queryMsg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return response, nil
 }
 
-func (proxy *DNSProxy) MakeFakeIP(r net.IP, zoneID string) string {
-	ip := proxy.zones[zoneID].Prefix
-	if len(r) == net.IPv6len {
-		ip[15] = r[15]
-		ip[14] = r[14]
-		ip[13] = r[13]
-		ip[12] = r[12]
+func exchangeContext(ctx context.Context, network string, server string, m *dns.Msg) (*dns.Msg, error) {
+	dnsClient := new(dns.Client)
+	dnsClient.Net = network
+	conn, err := dnsClient.DialContext(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// Unblock reading when the query is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	response, _, err := dnsClient.ExchangeWithConnContext(ctx, m, conn)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return response, err
+}
+
+// Advertise UDP buffer size in the message OPT record, keeping client's EDNS0 flags
+func setEDNS0(m *dns.Msg, size uint16) {
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetUDPSize(size)
+		return
+	}
+	m.SetEdns0(size, false)
+}
+
+// Fit response into the client buffer, setting TC if it doesn't fit.
+// Clients without EDNS0 get no OPT record and 512 bytes over UDP.
+func truncateResponse(requestMsg *dns.Msg, responseMsg *dns.Msg, network string) {
+	size := dns.MinMsgSize
+	if opt := requestMsg.IsEdns0(); opt != nil {
+		size = int(opt.UDPSize())
+		if respOpt := responseMsg.IsEdns0(); respOpt != nil {
+			respOpt.SetUDPSize(ednsUDPSize)
+		} else {
+			responseMsg.SetEdns0(ednsUDPSize, opt.Do())
+		}
 	} else {
-		ip[15] = r[3]
-		ip[14] = r[2]
-		ip[13] = r[1]
-		ip[12] = r[0]
+		extra := make([]dns.RR, 0, len(responseMsg.Extra))
+		for _, rr := range responseMsg.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		responseMsg.Extra = extra
+	}
+	if network != "udp" {
+		size = dns.MaxMsgSize
 	}
-	return ip.String()
+	responseMsg.Truncate(size)
+}
+
+// Synthesize IPv6 addresses of IPv4 one with zone prefixes (RFC 6052), none if r is not IPv4
+func (proxy *DNSProxy) MakeFakeIPs(r net.IP, zoneID string, client net.IP) []string {
+	ipv4, _ := netip.AddrFromSlice(r.To4())
+	if !ipv4.IsValid() {
+		return nil
+	}
+	zone := proxy.zones.Get(zoneID)
+	clientAddr, _ := netip.AddrFromSlice(client)
+	var ips []string
+	for _, prefix := range zone.Prefix.Select(zone.PrefixSelect, ipv4, clientAddr) {
+		ips = append(ips, prefix.Embed(ipv4).String())
+	}
+	return ips
+}
+
+// Synthesized AAAA records of name with the A record TTL, none if the zone has no prefix
+func (proxy *DNSProxy) fakeAAAA(name string, r net.IP, ttl uint32, zoneID string, client net.IP) []dns.RR {
+	var answer []dns.RR
+	for _, ip := range proxy.MakeFakeIPs(r, zoneID, client) {
+		rr, _ := dns.NewRR(name + " IN AAAA " + ip)
+		rr.Header().Ttl = ttl
+		answer = append(answer, rr)
+	}
+	return answer
 }
 
 func ReversePTR(ptr string) (net.IP, error) {
@@ -426,27 +670,20 @@ func ReversePTR(ptr string) (net.IP, error) {
 	return ip, nil
 }
 
-func (proxy *DNSProxy) ReversePTR(ptr string, zoneID string) (ipv4 net.IP, err error) {
-	var ip net.IP
-	ip, err = ReversePTR(ptr)
+// IPv4 address of synthesized IPv6 PTR name
+func (proxy *DNSProxy) ReversePTR(ptr string, zoneID string) (net.IP, error) {
+	ip, err := ReversePTR(ptr)
 	if err != nil {
-		return
+		return nil, err
 	}
 	if len(ip) != net.IPv6len {
-		err = fmt.Errorf("PTR is not IPv6")
+		return nil, fmt.Errorf("PTR is not IPv6")
 	}
-	for i := 0; i < 12; i++ {
-		if ip[i] != proxy.zones[zoneID].Prefix[i] {
-			err = fmt.Errorf("PTR doesn't have our prefix")
-			return
-		}
+	ipv4, ok := proxy.zones.Get(zoneID).Prefix.Extract(netip.AddrFrom16([16]byte(ip)))
+	if !ok {
+		return nil, fmt.Errorf("PTR doesn't have our prefix")
 	}
-	ipv4 = make([]byte, 4)
-	ipv4[3] = ip[15]
-	ipv4[2] = ip[14]
-	ipv4[1] = ip[13]
-	ipv4[0] = ip[12]
-	return
+	return net.IP(ipv4.AsSlice()), nil
 }
 
 func init() {
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"net"
+	"net/netip"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,10 +17,11 @@ func TestProcessTypeA(t *testing.T) {
 	// Start the mock DNS server
 	server, serverAddr := startMockDNSServer(t, handler)
 	defer server.Shutdown()
+	forwarder := newTestForwarder(t, ForwarderConfig{Upstreams: upstreamAddrs(serverAddr)})
 	proxy := &DNSProxy{
-		zones: map[string]ZoneConfig{
-			"zone1": {ReturnPublicIPv4: true},
-			"zone2": {ReturnPublicIPv4: false},
+		zones: Zones{
+			{Name: "zone1", ZoneConfig: ZoneConfig{ReturnPublicIPv4: true}},
+			{Name: "zone2", ZoneConfig: ZoneConfig{ReturnPublicIPv4: false}},
 		},
 	}
 
@@ -38,7 +43,7 @@ func TestProcessTypeA(t *testing.T) {
 			requestMsg := &dns.Msg{Question: []dns.Question{*q}}
 
 			// Call processTypeA
-			resp, err := proxy.processTypeA(serverAddr, lookup, q, requestMsg, tt.zoneID)
+			resp, err := proxy.processTypeA(forwarder, q, requestMsg, tt.zoneID)
 			if err != nil {
 				t.Errorf("processTypeA() error = %v", err)
 			}
@@ -86,32 +91,104 @@ func TestProcessTypeA(t *testing.T) {
 
 func TestGetZoneID(t *testing.T) {
 	// Mock data for zones
-	zones := map[string]ZoneConfig{
-		"zone1":   {Domains: []string{"example.com", "test.com"}},
-		"default": {Domains: []string{"."}},
+	zones := Zones{
+		{Name: "zone1", ZoneConfig: ZoneConfig{Domains: []string{"example.com", "test.com"}}},
+		{Name: "default", ZoneConfig: ZoneConfig{Domains: []string{"."}}},
+	}
+	// Overlapping zones, more specific first
+	overlapping := Zones{
+		{Name: "zone1", ZoneConfig: ZoneConfig{Domains: []string{"com.tr"}}},
+		{Name: "zone2", ZoneConfig: ZoneConfig{Domains: []string{"com", "tr"}}},
+		{Name: "default", ZoneConfig: ZoneConfig{Domains: []string{"."}}},
+	}
+	// Overlapping zones, less specific first
+	reversed := Zones{
+		{Name: "zone2", ZoneConfig: ZoneConfig{Domains: []string{"com", "tr", "example.org"}}},
+		{Name: "default", ZoneConfig: ZoneConfig{Domains: []string{"."}}},
+		{Name: "zone1", ZoneConfig: ZoneConfig{Domains: []string{"com.tr", "Example.org."}}},
 	}
-
-	dnsProxy := DNSProxy{zones: zones}
 
 	tests := []struct {
+		zones        Zones
 		domain       string
 		expectedZone string
 	}{
-		{"example.com.", "zone1"},                // Match example.com
-		{"api.test.com.", "zone1"},               // Match test.com
-		{"Example.com.", "zone1"},                // Case-insensitive match
-		{"blog.subdomain.example.com.", "zone1"}, // Match 4th level subdomain
-		{"supertest.com.", "default"},            // Tricky match to zone2
-		{"test.com.example.org.", "default"},     // Match subdomain.example.org
-		{"no-match-domain.com.", "default"},      // Default to .
-		{"", "default"},                          // Empty domain
+		{zones, "example.com.", "zone1"},                // Match example.com
+		{zones, "api.test.com.", "zone1"},               // Match test.com
+		{zones, "Example.com.", "zone1"},                // Case-insensitive match
+		{zones, "blog.subdomain.example.com.", "zone1"}, // Match 4th level subdomain
+		{zones, "supertest.com.", "default"},            // Tricky match to zone2
+		{zones, "test.com.example.org.", "default"},     // Match subdomain.example.org
+		{zones, "no-match-domain.com.", "default"},      // Default to .
+		{zones, "", "default"},                          // Empty domain
+		{overlapping, "shop.com.tr.", "zone1"},          // Most specific domain wins
+		{overlapping, "com.tr.", "zone1"},               // Exact match
+		{overlapping, "shop.com.", "zone2"},             // Only lower zone matches
+		{overlapping, "shop.tr.", "zone2"},              // Only lower zone matches
+		{overlapping, "shop.net.", "default"},           // Default to .
+		{reversed, "shop.com.tr.", "zone1"},             // Most specific domain wins
+		{reversed, "shop.tr.", "zone2"},                 // Less specific domain
+		{reversed, "www.example.org.", "zone2"},         // Same domain in two zones, upper wins
+		{reversed, "shop.net.", "default"},              // Default to . even if it is not the last
+		{reversed, "shopcom.tr.", "zone2"},              // Match on label boundaries only
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d/%s", i, tt.domain), func(t *testing.T) {
+			dnsProxy, err := NewDNSProxy(Config{Zones: tt.zones}, nil)
+			if err != nil {
+				t.Fatalf("NewDNSProxy() error = %v", err)
+			}
+			// Result must not depend on luck, check it several times
+			for i := 0; i < 10; i++ {
+				result := dnsProxy.getZoneID(tt.domain)
+				if result != tt.expectedZone {
+					t.Fatalf("getZoneID(%q) = %q; want %q", tt.domain, result, tt.expectedZone)
+				}
+			}
+		})
+	}
+}
+
+func TestGetForwarder(t *testing.T) {
+	dnsProxy, err := NewDNSProxy(Config{
+		Forwarders: map[string]ForwarderConfig{
+			".ygg":     {Upstreams: upstreamAddrs("[308:84:68:55::]:53")},
+			"sub.ygg":  {Upstreams: upstreamAddrs("[308:25:40:bd::]:53")},
+			".local.":  {Upstreams: upstreamAddrs("192.168.3.1:53")},
+			"ExAmPlE.": {Upstreams: upstreamAddrs("192.168.3.2:53")},
+		},
+		Default: ForwarderConfig{Upstreams: upstreamAddrs("8.8.8.8:53")},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewDNSProxy() error = %v", err)
+	}
+	defer dnsProxy.Close()
+
+	tests := []struct {
+		domain    string
+		forwarder string
+	}{
+		{"ygg.", "[308:84:68:55::]:53"},
+		{"alfis.ygg.", "[308:84:68:55::]:53"},
+		{"sub.ygg.", "[308:25:40:bd::]:53"},
+		{"www.sub.ygg.", "[308:25:40:bd::]:53"},
+		{"WWW.SUB.YGG.", "[308:25:40:bd::]:53"},
+		{"notsub.ygg.", "[308:84:68:55::]:53"},
+		{"fooygg.", "8.8.8.8:53"},
+		{"ygg.com.", "8.8.8.8:53"},
+		{"router.local.", "192.168.3.1:53"},
+		{"www.example.", "192.168.3.2:53"},
+		{".", "8.8.8.8:53"},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.domain, func(t *testing.T) {
-			result := dnsProxy.getZoneID(tt.domain)
-			if result != tt.expectedZone {
-				t.Errorf("getZoneID(%q) = %q; want %q", tt.domain, result, tt.expectedZone)
+			for i := 0; i < 10; i++ {
+				result := dnsProxy.getForwarder(tt.domain).String()
+				if result != tt.forwarder {
+					t.Fatalf("getForwarder(%q) = %q; want %q", tt.domain, result, tt.forwarder)
+				}
 			}
 		})
 	}
@@ -129,7 +206,8 @@ func startMockDNSServer(t *testing.T, handler dns.HandlerFunc) (*dns.Server, str
 		t.Fatalf("Failed to listen on UDP: %v", err)
 	}
 
-	server := &dns.Server{PacketConn: conn, Handler: handler}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
 	errChan := make(chan error)
 	go func() {
 		err := server.ActivateAndServe()
@@ -139,14 +217,26 @@ func startMockDNSServer(t *testing.T, handler dns.HandlerFunc) (*dns.Server, str
 	}()
 
 	select {
+	case <-started:
 	case err := <-errChan:
 		t.Fatalf("Failed to start mock DNS server: %v", err)
 	case <-time.After(5 * time.Second):
 		t.Fatalf("Failed to start mock DNS server: timeout")
 	}
 
+	// Serve TCP on the same port for truncated answers
+	tcpListener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to listen on TCP: %v", err)
+	}
+	tcpStarted := make(chan struct{})
+	tcpServer := &dns.Server{Listener: tcpListener, Handler: handler, NotifyStartedFunc: func() { close(tcpStarted) }}
+	go tcpServer.ActivateAndServe()
+	<-tcpStarted
+
 	t.Cleanup(func() {
 		server.Shutdown()
+		tcpServer.Shutdown()
 	})
 
 	return server, conn.LocalAddr().String()
@@ -189,12 +279,51 @@ func initDnsHandler() dns.HandlerFunc {
 				msg.Answer = append(msg.Answer, rr1)
 				rr2, _ := dns.NewRR("v4v6both.com. 3600 IN AAAA 2001:db8::3")
 				msg.Answer = append(msg.Answer, rr2)
+			case "v6public.com.":
+				// Respond with a public AAAA record
+				rr, _ := dns.NewRR("v6public.com. 3600 IN AAAA 2606:4700::1")
+				msg.Answer = append(msg.Answer, rr)
+			case "v4v6public.com.":
+				// Respond with an A and public AAAA records
+				rr1, _ := dns.NewRR("v4v6public.com. 3600 IN A 192.168.1.3")
+				msg.Answer = append(msg.Answer, rr1)
+				rr2, _ := dns.NewRR("v4v6public.com. 3600 IN AAAA 2606:4700::3")
+				msg.Answer = append(msg.Answer, rr2)
+			case "yggboth.com.":
+				// Respond with ygg and public AAAA records
+				rr1, _ := dns.NewRR("yggboth.com. 3600 IN AAAA 2606:4700::4")
+				msg.Answer = append(msg.Answer, rr1)
+				rr2, _ := dns.NewRR("yggboth.com. 3600 IN AAAA 200:1234::1")
+				msg.Answer = append(msg.Answer, rr2)
+			case "v6private.com.":
+				// Respond with unique local and documentation AAAA records
+				rr1, _ := dns.NewRR("v6private.com. 3600 IN AAAA fd00::1")
+				msg.Answer = append(msg.Answer, rr1)
+				rr2, _ := dns.NewRR("v6private.com. 3600 IN AAAA 2001:db8::5")
+				msg.Answer = append(msg.Answer, rr2)
+			case "bigtxt.com.":
+				// Respond with more TXT records than fit into UDP buffer
+				for i := 0; i < 40; i++ {
+					rr, _ := dns.NewRR(fmt.Sprintf("bigtxt.com. 3600 IN TXT \"%03d %s\"", i, strings.Repeat("x", 60)))
+					msg.Answer = append(msg.Answer, rr)
+				}
 			default:
 				// Return an empty response for unknown queries
 				msg.Rcode = dns.RcodeNameError
 			}
 		}
 
+		// Echo EDNS0 and truncate UDP answers like real servers do
+		if opt := r.IsEdns0(); opt != nil {
+			msg.SetEdns0(dns.DefaultMsgSize, opt.Do())
+		}
+		if w.LocalAddr().Network() == "udp" {
+			size := dns.MinMsgSize
+			if opt := r.IsEdns0(); opt != nil {
+				size = int(opt.UDPSize())
+			}
+			msg.Truncate(size)
+		}
 		w.WriteMsg(msg)
 	}
 	return handler
@@ -295,3 +424,139 @@ func TestLookup(t *testing.T) {
 		})
 	}
 }
+
+func TestLookupTruncated(t *testing.T) {
+	handler := initDnsHandler()
+	// Start the mock DNS server
+	_, serverAddr := startMockDNSServer(t, handler)
+
+	query := new(dns.Msg)
+	query.SetQuestion("bigtxt.com.", dns.TypeTXT)
+
+	// Plain UDP query gets truncated answer
+	udpResp, _, err := new(dns.Client).Exchange(query, serverAddr)
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if !udpResp.Truncated {
+		t.Fatalf("Mock server answer is not truncated")
+	}
+
+	resp, err := lookup(serverAddr, query)
+	if err != nil {
+		t.Fatalf("lookup() error = %v", err)
+	}
+	if resp.Truncated {
+		t.Errorf("lookup() returned truncated answer")
+	}
+	if len(resp.Answer) != 40 {
+		t.Errorf("lookup() answer length = %d, want 40", len(resp.Answer))
+	}
+	if opt := resp.IsEdns0(); opt == nil {
+		t.Errorf("lookup() did not advertise EDNS0 buffer size")
+	}
+	if query.IsEdns0() != nil {
+		t.Errorf("lookup() modified the query message")
+	}
+}
+
+func TestProcessTypeAAAAParallel(t *testing.T) {
+	delayed := func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(150 * time.Millisecond)
+		initDnsHandler()(w, r)
+	}
+	_, serverAddr := startMockDNSServer(t, delayed)
+
+	tests := []struct {
+		name     string
+		parallel bool
+		slowest  time.Duration
+	}{
+		{"Sequential", false, time.Second},
+		{"Parallel", true, 280 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarder := newTestForwarder(t, ForwarderConfig{Upstreams: upstreamAddrs(serverAddr), ParallelAAAA: tt.parallel})
+			proxy := &DNSProxy{
+				Cache: New(time.Minute, 0),
+				zones: Zones{
+					{Name: "default", ZoneConfig: ZoneConfig{Prefix: NAT64Prefixes{{netip.MustParsePrefix("300:dada:feda:f123:ff::/96")}}}},
+				},
+			}
+			q := &dns.Question{Name: "v4only.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}
+			requestMsg := &dns.Msg{Question: []dns.Question{*q}}
+
+			start := time.Now()
+			resp, err := proxy.processTypeAAAA(forwarder, q, requestMsg, "default", nil)
+			elapsed := time.Since(start)
+			if err != nil {
+				t.Fatalf("processTypeAAAA() error = %v", err)
+			}
+			if len(resp.Answer) != 1 || resp.Answer[0].(*dns.AAAA).AAAA.String() != "300:dada:feda:f123:ff:0:c0a8:101" {
+				t.Errorf("processTypeAAAA() answer = %v, want 300:dada:feda:f123:ff:0:c0a8:101", resp.Answer)
+			}
+			if elapsed >= tt.slowest {
+				t.Errorf("processTypeAAAA() took %v, want less than %v", elapsed, tt.slowest)
+			}
+		})
+	}
+}
+
+func TestReturnPublicIPv6(t *testing.T) {
+	_, serverAddr := startMockDNSServer(t, initDnsHandler())
+	forwarder := newTestForwarder(t, ForwarderConfig{Upstreams: upstreamAddrs(serverAddr)})
+
+	tests := []struct {
+		name     string
+		query    string
+		qtype    uint16
+		public   bool
+		expected []string
+	}{
+		{"Public AAAA is dropped", "v4v6public.com.", dns.TypeAAAA, false, []string{"300:dada:feda:f123:ff:0:c0a8:103"}},
+		{"Public AAAA follows synthesized", "v4v6public.com.", dns.TypeAAAA, true, []string{"300:dada:feda:f123:ff:0:c0a8:103", "2606:4700::3"}},
+		{"Ygg AAAA only", "yggboth.com.", dns.TypeAAAA, false, []string{"200:1234::1"}},
+		{"Public AAAA follows ygg", "yggboth.com.", dns.TypeAAAA, true, []string{"200:1234::1", "2606:4700::4"}},
+		{"Public AAAA without A", "v6public.com.", dns.TypeAAAA, true, []string{"2606:4700::1"}},
+		{"Private AAAA is not public", "v6private.com.", dns.TypeAAAA, true, nil},
+		{"ANY without public AAAA", "v4v6public.com.", dns.TypeANY, false, []string{"300:dada:feda:f123:ff:0:c0a8:103"}},
+		{"ANY with public AAAA", "v4v6public.com.", dns.TypeANY, true, []string{"300:dada:feda:f123:ff:0:c0a8:103", "2606:4700::3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := &DNSProxy{
+				Cache: New(time.Minute, 0),
+				zones: Zones{
+					{Name: "default", ZoneConfig: ZoneConfig{Prefix: NAT64Prefixes{{netip.MustParsePrefix("300:dada:feda:f123:ff::/96")}}, ReturnPublicIPv6: tt.public}},
+				},
+			}
+			// The second query is answered from cache
+			for i := 0; i < 2; i++ {
+				q := &dns.Question{Name: tt.query, Qtype: tt.qtype, Qclass: dns.ClassINET}
+				requestMsg := &dns.Msg{Question: []dns.Question{*q}}
+				var resp *dns.Msg
+				var err error
+				if tt.qtype == dns.TypeANY {
+					resp, err = proxy.processTypeANY(forwarder, q, requestMsg, "default", nil)
+				} else {
+					resp, err = proxy.processTypeAAAA(forwarder, q, requestMsg, "default", nil)
+				}
+				if err != nil {
+					t.Fatalf("process() error = %v", err)
+				}
+				var result []string
+				for _, rr := range resp.Answer {
+					if aaaa, ok := rr.(*dns.AAAA); ok {
+						result = append(result, aaaa.AAAA.String())
+					}
+				}
+				if !reflect.DeepEqual(result, tt.expected) {
+					t.Errorf("Answer #%d = %v, want %v", i+1, result, tt.expected)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+)
+
+// Tree of domain labels. A value set for a domain applies to all its subdomains,
+// lookups return the value of the most specific domain matching on label boundaries.
+type domainTree[T any] struct {
+	root *domainNode[T]
+}
+
+type domainNode[T any] struct {
+	children map[string]*domainNode[T]
+	value    T
+	hasValue bool
+}
+
+func newDomainTree[T any]() *domainTree[T] {
+	return &domainTree[T]{root: &domainNode[T]{}}
+}
+
+// Split domain into lowercase labels from TLD to host. "." and "" are the root
+func domainLabels(domain string) []string {
+	domain = strings.Trim(strings.ToLower(domain), ".")
+	if domain == "" {
+		return nil
+	}
+	labels := strings.Split(domain, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+// Set value for domain. If the domain already has a value, it is kept and false is returned.
+func (t *domainTree[T]) Insert(domain string, value T) bool {
+	node := t.root
+	for _, label := range domainLabels(domain) {
+		child, ok := node.children[label]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*domainNode[T])
+			}
+			child = &domainNode[T]{}
+			node.children[label] = child
+		}
+		node = child
+	}
+	if node.hasValue {
+		return false
+	}
+	node.value = value
+	node.hasValue = true
+	return true
+}
+
+// Find value of the most specific domain which name belongs to
+func (t *domainTree[T]) Lookup(name string) (value T, found bool) {
+	node := t.root
+	if node.hasValue {
+		value, found = node.value, true
+	}
+	for _, label := range domainLabels(name) {
+		node = node.children[label]
+		if node == nil {
+			break
+		}
+		if node.hasValue {
+			value, found = node.value, true
+		}
+	}
+	return
+}
+
+// Call fn for every value in the tree
+func (t *domainTree[T]) Walk(fn func(value T)) {
+	t.root.walk(fn)
+}
+
+func (n *domainNode[T]) walk(fn func(value T)) {
+	if n.hasValue {
+		fn(n.value)
+	}
+	for _, child := range n.children {
+		child.walk(fn)
+	}
+}
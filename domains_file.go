@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Read domains list file. Lines hold one domain each, or an address followed
+// by domains in hosts file format. Everything after "#" is a comment.
+// Invalid entries are skipped and returned in rejected.
+func readDomainsFile(fileName string) (domains []string, rejected []string, err error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	domains, rejected, err = parseDomains(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return domains, rejected, nil
+}
+
+// Domains of the list. Hosts entries of addresses like "0.0.0.0 0.0.0.0"
+// are left out, other invalid names are skipped and returned in rejected,
+// so one stray line doesn't take the whole list down.
+func parseDomains(r io.Reader) (domains []string, rejected []string, err error) {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		hosts := len(fields) > 1 && net.ParseIP(fields[0]) != nil
+		if hosts {
+			fields = fields[1:]
+		}
+		for _, domain := range fields {
+			if hosts && net.ParseIP(domain) != nil {
+				continue
+			}
+			domain = strings.TrimPrefix(domain, "*.")
+			if !validDomain(domain) {
+				rejected = append(rejected, fmt.Sprintf("line %d: invalid domain name %q", n, domain))
+				continue
+			}
+			domains = append(domains, domain)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return domains, rejected, nil
+}
+
+// Rejected entries of a list for the log, the first few of them
+func rejectedSummary(rejected []string) string {
+	const shown = 3
+	if len(rejected) > shown {
+		return fmt.Sprintf("%s and %d more", strings.Join(rejected[:shown], ", "), len(rejected)-shown)
+	}
+	return strings.Join(rejected, ", ")
+}
+
+// Size and modification time a file had when it was read
+type fileState struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func statFile(fileName string) fileState {
+	state := fileState{name: fileName}
+	if info, err := os.Stat(fileName); err == nil {
+		state.size, state.modTime = info.Size(), info.ModTime()
+	}
+	return state
+}
+
+func (s fileState) changed() bool {
+	return statFile(s.name) != s
+}
+
+// Build zone lookup tree from zones domains, domains files and copies of remote lists.
+// The same domain in several zones belongs to the upper one. Files with invalid
+// entries are listed in warnings, their valid entries are used.
+func buildZoneTree(zones Zones, listsDir string) (tree *domainTree[string], files []fileState, warnings []string, err error) {
+	tree = newDomainTree[string]()
+	// Copies of remote lists are rebuilt by refreshLists, they aren't watched
+	insertFile := func(zone Zone, fileName string, remote bool) error {
+		if !remote {
+			// State is taken before reading, so changes made while reading are seen next time
+			files = append(files, statFile(fileName))
+		}
+		domains, rejected, err := readDomainsFile(fileName)
+		if remote && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("zone %s: %w", zone.Name, err)
+		}
+		if len(rejected) > 0 {
+			warnings = append(warnings, fmt.Sprintf("zone %s: %s: skipped %s", zone.Name, fileName, rejectedSummary(rejected)))
+		}
+		for _, domain := range domains {
+			tree.Insert(domain, zone.Name)
+		}
+		return nil
+	}
+	for _, zone := range zones {
+		for _, domain := range zone.Domains {
+			tree.Insert(domain, zone.Name)
+		}
+		for _, fileName := range zone.DomainsFiles {
+			if err := insertFile(zone, fileName, false); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		// Remote list is empty until it is downloaded for the first time
+		for _, listURL := range zone.DomainsURLs {
+			if err := insertFile(zone, listFile(listsDir, listURL), true); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	}
+	return tree, files, warnings, nil
+}
+
+// Rebuild zone tree. On errors the current tree is kept.
+func (proxy *DNSProxy) reloadZones() error {
+	proxy.zonesMu.Lock()
+	defer proxy.zonesMu.Unlock()
+	tree, files, warnings, err := buildZoneTree(proxy.zones, proxy.listsDir)
+	if err != nil {
+		// Don't retry until the files change again
+		for i := range proxy.zoneFiles {
+			proxy.zoneFiles[i] = statFile(proxy.zoneFiles[i].name)
+		}
+		return err
+	}
+	for _, warning := range warnings {
+		proxy.logger.Infof("Warning: %s\n", warning)
+	}
+	proxy.zoneIDs.Store(tree)
+	proxy.zoneFiles = files
+	return nil
+}
+
+func (proxy *DNSProxy) zoneFilesChanged() bool {
+	proxy.zonesMu.Lock()
+	defer proxy.zonesMu.Unlock()
+	for _, f := range proxy.zoneFiles {
+		if f.changed() {
+			return true
+		}
+	}
+	return false
+}
+
+// Rebuild zone tree when domains files change
+func (proxy *DNSProxy) watchDomainsFiles(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-proxy.stop:
+			return
+		case <-ticker.C:
+		}
+		if !proxy.zoneFilesChanged() {
+			continue
+		}
+		if err := proxy.reloadZones(); err != nil {
+			proxy.logger.Errorf("Failed to reload domains files: %s\n", err.Error())
+			continue
+		}
+		proxy.logger.Infof("Domains files reloaded\n")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDomains(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected []string
+	}{
+		{"Plain list", "example.com\n.ru\n\ncom.tr.\n", []string{"example.com", ".ru", "com.tr."}},
+		{"Comments", "# Direct zone\nexample.com # inline\n  # indented\n", []string{"example.com"}},
+		{"Hosts format", "0.0.0.0 ads.example.com tracker.example.com\n::1 localhost\n", []string{"ads.example.com", "tracker.example.com", "localhost"}},
+		{"Hosts address entries", "127.0.0.1 localhost\n0.0.0.0 0.0.0.0\n0.0.0.0 ads.example.com\n", []string{"localhost", "ads.example.com"}},
+		{"Wildcards", "*.example.com\r\n", []string{"example.com"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domains, rejected, err := parseDomains(strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("parseDomains() error = %v", err)
+			}
+			if !reflect.DeepEqual(domains, tt.expected) || len(rejected) != 0 {
+				t.Errorf("parseDomains() = %v, rejected %v, want %v", domains, rejected, tt.expected)
+			}
+		})
+	}
+
+	// Invalid entries are skipped, the rest of the list is kept
+	domains, rejected, err := parseDomains(strings.NewReader("example.com\nexa mple!.com\n1.2.3.4\nexample.org\n"))
+	if err != nil {
+		t.Fatalf("parseDomains() error = %v", err)
+	}
+	if !reflect.DeepEqual(domains, []string{"example.com", "exa", "example.org"}) {
+		t.Errorf("parseDomains() with invalid entries = %v", domains)
+	}
+	if len(rejected) != 2 || !strings.HasPrefix(rejected[0], "line 2") || !strings.HasPrefix(rejected[1], "line 3") {
+		t.Errorf("parseDomains() rejected = %v, want lines 2 and 3", rejected)
+	}
+}
+
+// Replace file at once, so the watcher never reads it half written
+func writeDomainsFile(t *testing.T, fileName string, body string) {
+	tmp := fileName + ".tmp"
+	if err := os.WriteFile(tmp, []byte(body), 0o600); err != nil {
+		t.Fatalf("Failed to write domains file: %v", err)
+	}
+	if err := os.Rename(tmp, fileName); err != nil {
+		t.Fatalf("Failed to replace domains file: %v", err)
+	}
+}
+
+func TestDomainsFilesWatch(t *testing.T) {
+	dir := t.TempDir()
+	direct := filepath.Join(dir, "direct.txt")
+	hosts := filepath.Join(dir, "hosts")
+	writeDomainsFile(t, direct, "ru\ncom.tr\n")
+	writeDomainsFile(t, hosts, "0.0.0.0 example.com\n")
+
+	proxy, err := NewDNSProxy(Config{
+		Zones: Zones{
+			{Name: "direct", ZoneConfig: ZoneConfig{DomainsFiles: stringList{direct, hosts}}},
+			{Name: "default", ZoneConfig: ZoneConfig{Domains: []string{"."}}},
+		},
+		WatchInterval: 10 * time.Millisecond,
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewDNSProxy() error = %v", err)
+	}
+	defer proxy.Close()
+
+	for domain, expected := range map[string]string{"ya.ru.": "direct", "www.example.com.": "direct", "example.org.": "default"} {
+		if zoneID := proxy.getZoneID(domain); zoneID != expected {
+			t.Errorf("getZoneID(%s) = %s, want %s", domain, zoneID, expected)
+		}
+	}
+
+	waitZone := func(domain string, expected string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for proxy.getZoneID(domain) != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("getZoneID(%s) = %s after file change, want %s", domain, proxy.getZoneID(domain), expected)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Changes are picked up
+	writeDomainsFile(t, direct, "com.tr\norg\n")
+	waitZone("example.org.", "direct")
+	waitZone("ya.ru.", "default")
+
+	// Invalid lines are skipped
+	writeDomainsFile(t, direct, "org\nbroken_domain!\nru\n")
+	waitZone("ya.ru.", "direct")
+	if zoneID := proxy.getZoneID("example.org."); zoneID != "direct" {
+		t.Errorf("getZoneID() after invalid line = %s, want direct", zoneID)
+	}
+
+	// Missing file fails the start
+	_, err = NewDNSProxy(Config{
+		Zones: Zones{{Name: "direct", ZoneConfig: ZoneConfig{DomainsFiles: stringList{filepath.Join(dir, "missing.txt")}}}},
+	}, nil)
+	if err == nil {
+		t.Errorf("NewDNSProxy() with missing domains file succeeded")
+	}
+}
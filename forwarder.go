@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream selection policy
+type Policy int64
+
+const (
+	FailoverPolicy   Policy = 0
+	RoundRobinPolicy Policy = 1
+	FastestPolicy    Policy = 2
+)
+
+const (
+	defaultUpstreamTimeout = 2 * time.Second
+	defaultCheckInterval   = 10 * time.Second
+	defaultMaxFails        = 3
+)
+
+// Upstream with its health state
+type upstreamState struct {
+	Upstream
+	fails atomic.Int32
+	down  atomic.Bool
+	rtt   atomic.Int64 // Smoothed round trip time in nanoseconds, 0 - not measured yet
+}
+
+// Group of upstream servers serving one forwarder entry
+type Forwarder struct {
+	upstreams     []*upstreamState
+	policy        Policy
+	maxFails      int32
+	checkInterval time.Duration
+	race          int
+	parallelAAAA  bool
+	next          atomic.Uint32
+	stop          chan struct{}
+	stopOnce      sync.Once
+}
+
+func NewForwarder(cfg ForwarderConfig) (*Forwarder, error) {
+	if len(cfg.Upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream servers")
+	}
+	f := &Forwarder{
+		policy:        cfg.Policy,
+		maxFails:      int32(cfg.MaxFails),
+		checkInterval: cfg.CheckInterval,
+		race:          cfg.Race,
+		parallelAAAA:  cfg.ParallelAAAA,
+		stop:          make(chan struct{}),
+	}
+	if f.maxFails <= 0 {
+		f.maxFails = defaultMaxFails
+	}
+	if f.checkInterval <= 0 {
+		f.checkInterval = defaultCheckInterval
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultUpstreamTimeout
+	}
+	for _, ucfg := range cfg.Upstreams {
+		upstream, err := newUpstream(ucfg, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", ucfg.Address, err)
+		}
+		f.upstreams = append(f.upstreams, &upstreamState{Upstream: upstream})
+	}
+	go f.healthCheck()
+	return f, nil
+}
+
+// Send query to upstreams in policy order until one of them answers.
+// SERVFAIL and REFUSED answers are passed on only if no other upstream answers better.
+func (f *Forwarder) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return f.ExchangeContext(context.Background(), m)
+}
+
+// Same as Exchange, aborting the query when ctx is done.
+// In race mode the first upstreams are queried at once and the first usable answer wins.
+func (f *Forwarder) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if f == nil {
+		return nil, fmt.Errorf("no forwarder for %s", questionName(m))
+	}
+	order := f.order()
+	n := 1
+	if f.race > 1 {
+		n = min(f.race, len(order))
+	}
+
+	response, err := f.raceExchange(ctx, order[:n], m)
+	if response != nil && usable(response) {
+		return response, nil
+	}
+	for _, u := range order[n:] {
+		if ctx.Err() != nil {
+			break
+		}
+		r, uerr := f.exchange(ctx, u, m)
+		if uerr != nil {
+			err = uerr
+			continue
+		}
+		response = r
+		if usable(r) {
+			return r, nil
+		}
+	}
+	if response != nil {
+		return response, nil
+	}
+	return nil, err
+}
+
+// Query upstreams at once, cancel the rest when one of them gives usable answer.
+// Without usable answers the last received one is returned.
+func (f *Forwarder) raceExchange(ctx context.Context, upstreams []*upstreamState, m *dns.Msg) (*dns.Msg, error) {
+	if len(upstreams) == 1 {
+		return f.exchange(ctx, upstreams[0], m)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan exchangeResult, len(upstreams))
+	for _, u := range upstreams {
+		go func(u *upstreamState) {
+			r, err := f.exchange(ctx, u, m)
+			results <- exchangeResult{r, err}
+		}(u)
+	}
+
+	var response *dns.Msg
+	var err error
+	for range upstreams {
+		res := <-results
+		if res.err != nil {
+			err = res.err
+			continue
+		}
+		response = res.msg
+		if usable(res.msg) {
+			return res.msg, nil
+		}
+	}
+	return response, err
+}
+
+// Should AAAA and A be looked up at once
+func (f *Forwarder) ParallelAAAA() bool {
+	return f != nil && f.parallelAAAA
+}
+
+// Query one upstream and update its health state
+func (f *Forwarder) exchange(ctx context.Context, u *upstreamState, m *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	r, err := u.Exchange(ctx, m)
+	if err != nil {
+		if ctx.Err() != nil {
+			// Cancelled by us, not the upstream fault
+			return nil, err
+		}
+		if u.fails.Add(1) >= f.maxFails {
+			u.down.Store(true)
+		}
+		return nil, err
+	}
+	u.fails.Store(0)
+	u.down.Store(false)
+	u.observeRTT(time.Since(start))
+	return r, nil
+}
+
+// Upstreams in the order they should be tried. Healthy upstreams go first,
+// down ones are still tried as a last resort.
+func (f *Forwarder) order() []*upstreamState {
+	list := make([]*upstreamState, len(f.upstreams))
+	copy(list, f.upstreams)
+
+	switch f.policy {
+	case RoundRobinPolicy:
+		n := int((f.next.Add(1) - 1) % uint32(len(list)))
+		list = append(list[n:], list[:n]...)
+	case FastestPolicy:
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].rtt.Load() < list[j].rtt.Load()
+		})
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return !list[i].down.Load() && list[j].down.Load()
+	})
+	return list
+}
+
+// Probe down upstreams until they answer again
+func (f *Forwarder) healthCheck() {
+	ticker := time.NewTicker(f.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+		for _, u := range f.upstreams {
+			if !u.down.Load() {
+				continue
+			}
+			probe := new(dns.Msg)
+			probe.SetQuestion(".", dns.TypeNS)
+			f.exchange(context.Background(), u, probe)
+		}
+	}
+}
+
+// Stop health checks and close upstream connections
+func (f *Forwarder) Close() {
+	if f == nil {
+		return
+	}
+	f.stopOnce.Do(func() {
+		close(f.stop)
+		for _, u := range f.upstreams {
+			u.Close()
+		}
+	})
+}
+
+func (f *Forwarder) String() string {
+	if f == nil {
+		return "none"
+	}
+	s := ""
+	for i, u := range f.upstreams {
+		if i > 0 {
+			s += ", "
+		}
+		s += u.String()
+	}
+	return s
+}
+
+// Smooth round trip time, new samples weight 30%
+func (u *upstreamState) observeRTT(rtt time.Duration) {
+	old := u.rtt.Load()
+	if old == 0 {
+		u.rtt.Store(int64(rtt))
+		return
+	}
+	u.rtt.Store((old*7 + int64(rtt)*3) / 10)
+}
+
+// Answer that doesn't need to be asked elsewhere
+func usable(m *dns.Msg) bool {
+	return m.Rcode != dns.RcodeServerFailure && m.Rcode != dns.RcodeRefused
+}
+
+func questionName(m *dns.Msg) string {
+	if len(m.Question) == 0 {
+		return "empty question"
+	}
+	return m.Question[0].Name
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestForwarder(t *testing.T, cfg ForwarderConfig) *Forwarder {
+	forwarder, err := NewForwarder(cfg)
+	if err != nil {
+		t.Fatalf("NewForwarder() error = %v", err)
+	}
+	t.Cleanup(forwarder.Close)
+	return forwarder
+}
+
+func upstreamAddrs(addrs ...string) []UpstreamConfig {
+	upstreams := make([]UpstreamConfig, 0, len(addrs))
+	for _, addr := range addrs {
+		upstreams = append(upstreams, UpstreamConfig{Address: addr})
+	}
+	return upstreams
+}
+
+// Mock upstream answering "who.test." with its own address.
+// While broken is set, queries are left without answer.
+func startMockUpstream(t *testing.T, ip string, delay time.Duration, broken *atomic.Bool) string {
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		if broken != nil && broken.Load() {
+			return
+		}
+		time.Sleep(delay)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		if r.Question[0].Name == "who.test." {
+			rr, _ := dns.NewRR("who.test. 3600 IN A " + ip)
+			msg.Answer = append(msg.Answer, rr)
+		}
+		w.WriteMsg(msg)
+	}
+	_, addr := startMockDNSServer(t, handler)
+	return addr
+}
+
+// Address nobody listens on
+func deadUpstream(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen on UDP: %v", err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+func askWho(t *testing.T, forwarder *Forwarder) string {
+	query := new(dns.Msg)
+	query.SetQuestion("who.test.", dns.TypeA)
+	resp, err := forwarder.Exchange(query)
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("Exchange() answer length = %d, want 1", len(resp.Answer))
+	}
+	return resp.Answer[0].(*dns.A).A.String()
+}
+
+func TestForwarderFailover(t *testing.T) {
+	first := startMockUpstream(t, "10.0.0.1", 0, nil)
+	second := startMockUpstream(t, "10.0.0.2", 0, nil)
+
+	tests := []struct {
+		name      string
+		upstreams []string
+		expected  string
+	}{
+		{"First upstream answers", []string{first, second}, "10.0.0.1"},
+		{"Order is kept", []string{second, first}, "10.0.0.2"},
+		{"Dead upstream is skipped", []string{deadUpstream(t), second}, "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarder := newTestForwarder(t, ForwarderConfig{Upstreams: upstreamAddrs(tt.upstreams...), Timeout: 200 * time.Millisecond})
+			for i := 0; i < 5; i++ {
+				if result := askWho(t, forwarder); result != tt.expected {
+					t.Fatalf("Exchange() answered by %s, want %s", result, tt.expected)
+				}
+			}
+		})
+	}
+
+	forwarder := newTestForwarder(t, ForwarderConfig{Upstreams: upstreamAddrs(deadUpstream(t), deadUpstream(t)), Timeout: 200 * time.Millisecond})
+	query := new(dns.Msg)
+	query.SetQuestion("who.test.", dns.TypeA)
+	if _, err := forwarder.Exchange(query); err == nil {
+		t.Errorf("Exchange() with all upstreams dead succeeded")
+	}
+
+	// Client gets SERVFAIL matching its query, with no upstream alive or no forwarder at all
+	for _, upstreams := range [][]UpstreamConfig{upstreamAddrs(deadUpstream(t)), nil} {
+		proxy, err := NewDNSProxy(Config{
+			Default: ForwarderConfig{Upstreams: upstreams, Timeout: 200 * time.Millisecond},
+			Zones:   Zones{{Name: "default", ZoneConfig: ZoneConfig{Domains: []string{"."}}}},
+		}, nil)
+		if err != nil {
+			t.Fatalf("NewDNSProxy() error = %v", err)
+		}
+		defer proxy.Close()
+		resp, err := proxy.getResponse(query, nil)
+		if err == nil {
+			t.Errorf("getResponse() with no upstream alive succeeded")
+		}
+		if resp.Id != query.Id || !resp.Response || resp.Rcode != dns.RcodeServerFailure || len(resp.Question) != 1 {
+			t.Errorf("getResponse() = %v, want SERVFAIL reply to query %d", resp, query.Id)
+		}
+	}
+}
+
+func TestForwarderRoundRobin(t *testing.T) {
+	upstreams := []string{
+		startMockUpstream(t, "10.0.0.1", 0, nil),
+		startMockUpstream(t, "10.0.0.2", 0, nil),
+		startMockUpstream(t, "10.0.0.3", 0, nil),
+	}
+	forwarder := newTestForwarder(t, ForwarderConfig{Upstreams: upstreamAddrs(upstreams...), Policy: RoundRobinPolicy})
+
+	counts := make(map[string]int)
+	for i := 0; i < 9; i++ {
+		counts[askWho(t, forwarder)]++
+	}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if counts[ip] != 3 {
+			t.Errorf("Upstream %s answered %d times, want 3", ip, counts[ip])
+		}
+	}
+}
+
+func TestForwarderFastest(t *testing.T) {
+	upstreams := []string{
+		startMockUpstream(t, "10.0.0.1", 50*time.Millisecond, nil),
+		startMockUpstream(t, "10.0.0.2", 0, nil),
+	}
+	forwarder := newTestForwarder(t, ForwarderConfig{Upstreams: upstreamAddrs(upstreams...), Policy: FastestPolicy})
+
+	// Measure both upstreams
+	for _, u := range forwarder.upstreams {
+		query := new(dns.Msg)
+		query.SetQuestion("who.test.", dns.TypeA)
+		if _, err := forwarder.exchange(context.Background(), u, query); err != nil {
+			t.Fatalf("exchange() error = %v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if result := askWho(t, forwarder); result != "10.0.0.2" {
+			t.Fatalf("Exchange() answered by %s, want the fastest 10.0.0.2", result)
+		}
+	}
+}
+
+func TestForwarderHealthCheck(t *testing.T) {
+	var broken atomic.Bool
+	broken.Store(true)
+	first := startMockUpstream(t, "10.0.0.1", 0, &broken)
+	second := startMockUpstream(t, "10.0.0.2", 0, nil)
+	forwarder := newTestForwarder(t, ForwarderConfig{
+		Upstreams:     upstreamAddrs(first, second),
+		Timeout:       100 * time.Millisecond,
+		MaxFails:      2,
+		CheckInterval: 50 * time.Millisecond,
+	})
+
+	for i := 0; i < 2; i++ {
+		if result := askWho(t, forwarder); result != "10.0.0.2" {
+			t.Fatalf("Exchange() answered by %s, want 10.0.0.2", result)
+		}
+	}
+	if !forwarder.upstreams[0].down.Load() {
+		t.Fatalf("Upstream is not marked down after timeouts")
+	}
+
+	// Down upstream is not asked anymore
+	start := time.Now()
+	askWho(t, forwarder)
+	if time.Since(start) >= 100*time.Millisecond {
+		t.Errorf("Exchange() waited for the down upstream")
+	}
+
+	// Probes bring it back
+	broken.Store(false)
+	deadline := time.Now().Add(2 * time.Second)
+	for forwarder.upstreams[0].down.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Upstream is not brought back by probes")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if result := askWho(t, forwarder); result != "10.0.0.1" {
+		t.Errorf("Exchange() answered by %s, want recovered 10.0.0.1", result)
+	}
+}
+
+func TestForwarderRace(t *testing.T) {
+	slow := startMockUpstream(t, "10.0.0.1", 300*time.Millisecond, nil)
+	fast := startMockUpstream(t, "10.0.0.2", 0, nil)
+
+	tests := []struct {
+		name     string
+		race     int
+		expected string
+	}{
+		{"Race disabled", 0, "10.0.0.1"},
+		{"Race of two", 2, "10.0.0.2"},
+		{"Race wider than upstreams", 5, "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarder := newTestForwarder(t, ForwarderConfig{Upstreams: upstreamAddrs(slow, fast), Race: tt.race})
+			if result := askWho(t, forwarder); result != tt.expected {
+				t.Errorf("Exchange() answered by %s, want %s", result, tt.expected)
+			}
+		})
+	}
+
+	// Losers are cancelled, they are not counted as failures
+	forwarder := newTestForwarder(t, ForwarderConfig{Upstreams: upstreamAddrs(slow, fast), Race: 2, MaxFails: 1})
+	start := time.Now()
+	askWho(t, forwarder)
+	if time.Since(start) >= 300*time.Millisecond {
+		t.Errorf("Exchange() waited for the slow upstream")
+	}
+	if forwarder.upstreams[0].down.Load() {
+		t.Errorf("Cancelled upstream is marked down")
+	}
+
+	// Failed racers fall back to the rest of upstreams
+	forwarder = newTestForwarder(t, ForwarderConfig{Upstreams: upstreamAddrs(deadUpstream(t), deadUpstream(t), fast), Race: 2})
+	if result := askWho(t, forwarder); result != "10.0.0.2" {
+		t.Errorf("Exchange() answered by %s, want 10.0.0.2", result)
+	}
+}
@@ -3,30 +3,50 @@ package main
 import (
 	"log"
 	"os"
+	"sync/atomic"
 )
 
 const (
-	infoLevel = 1
-	errLevel  = 2
+	infoLevel  = 1
+	errLevel   = 2
+	debugLevel = 3
 )
 
 type Log struct {
-	level int
+	level atomic.Int32
 }
 
 func NewLogger(logLevel string) *Log {
-	if logLevel == "err" {
-		return &Log{1}
-	}
-	if logLevel == "info" {
-		return &Log{2}
+	l := new(Log)
+	l.SetLevel(logLevel)
+	return l
+}
+
+// Change level of logger in use, like on config reload
+func (l *Log) SetLevel(logLevel string) {
+	switch logLevel {
+	case "err":
+		l.level.Store(1)
+	case "info":
+		l.level.Store(2)
+	case "debug":
+		l.level.Store(debugLevel)
+	default:
+		l.level.Store(0)
 	}
+}
 
-	return &Log{0}
+// Debug messages are written for every query, nil logger writes nothing
+func (l *Log) Debugf(format string, args ...interface{}) {
+	if l != nil && l.level.Load() >= debugLevel {
+		log.SetPrefix("DEBUG: ")
+		log.SetOutput(os.Stdout)
+		log.Printf(format, args...)
+	}
 }
 
 func (l *Log) Infof(format string, args ...interface{}) {
-	if l.level >= infoLevel {
+	if l.level.Load() >= infoLevel {
 		log.SetPrefix("INFO: ")
 		log.SetOutput(os.Stdout)
 		log.Printf(format, args...)
@@ -34,7 +54,7 @@ func (l *Log) Infof(format string, args ...interface{}) {
 }
 
 func (l *Log) Errorf(format string, args ...interface{}) {
-	if l.level >= errLevel {
+	if l.level.Load() >= errLevel {
 		log.SetPrefix("ERROR: ")
 		log.SetOutput(os.Stderr)
 		log.Printf(format, args...)
@@ -3,11 +3,17 @@ package main
 // Based on https://github.com/katakonst/go-dns-proxy/releases
 
 import (
+	"context"
+	"errors"
+	"expvar"
+	"io/fs"
 	"log"
-	"net"
-	"time"
-
-	"github.com/miekg/dns"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
 )
 
 func main() {
@@ -16,36 +22,114 @@ func main() {
 		log.Fatalf("Failed to load configs: %s", err)
 	}
 
-	if len(cfg.Zones["default"].Prefix) != net.IPv6len || cfg.Zones["default"].Prefix.IsUnspecified() {
-		log.Fatalf("Wrong prefix format: %s", cfg.Zones["default"].Prefix)
+	for _, warning := range cfg.Warnings() {
+		log.Printf("Warning: %s", warning)
 	}
-
-	dnsProxy := DNSProxy{
-		Cache:          New(cfg.Cache.ExpTime*time.Minute, cfg.Cache.PurgeTime*time.Minute),
-		forwarders:     cfg.Forwarders,
-		static:         cfg.Static,
-		defaultForward: cfg.Default,
-		ia:             cfg.IA,
-		zones:          cfg.Zones,
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid config %s:\n%s", *configFile, err)
+	}
+	if *checkOnly {
+		log.Printf("Config %s is valid", *configFile)
+		return
 	}
 
+	ednsUDPSize = cfg.UDPSize
+
 	logger := NewLogger(cfg.LogLevel)
 
-	dns.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
-		switch r.Opcode {
-		case dns.OpcodeQuery:
-			m, err := dnsProxy.getResponse(r)
+	cache := cacheFromConfig(cfg)
+	if cfg.Cache.File != "" {
+		err := cache.LoadFile(cfg.Cache.File)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Errorf("Failed to load cache: %s\n", err.Error())
+		}
+	}
+
+	dnsProxy, err := NewDNSProxy(cfg, cache)
+	if err != nil {
+		logger.Fatalf("Failed to init proxy: %s\n", err.Error())
+	}
+	var current atomic.Pointer[DNSProxy]
+	current.Store(dnsProxy)
+	expvar.Publish("cache_items", expvar.Func(func() interface{} {
+		return current.Load().Cache.ItemCount()
+	}))
+	expvar.Publish("cache_bytes", expvar.Func(func() interface{} {
+		return current.Load().Cache.Bytes()
+	}))
+	expvar.Publish("cache_evictions", expvar.Func(func() interface{} {
+		return current.Load().Cache.Evictions()
+	}))
+	var metrics *http.Server
+	if cfg.Metrics != "" {
+		metrics = serveMetrics(cfg.Metrics, logger)
+	}
+
+	servers, err := startServers(cfg.Listen, newHandler(&current, logger))
+	if err != nil {
+		logger.Fatalf("Failed to start server: %s\n", err.Error())
+	}
+	for _, addr := range servers.Addrs() {
+		logger.Infof("Starting at %s/%s\n", addr.Network(), addr)
+	}
+
+	// Settings of the last loaded config, the rest of cfg is kept until restart
+	var settings atomic.Pointer[Config]
+	settings.Store(&cfg)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			newCfg, err := reloadConfig(*configFile, &current)
 			if err != nil {
-				logger.Errorf("Failed lookup for %s with error: %s\n", r, err.Error())
+				logger.Errorf("Failed to reload config, keeping the old one: %s\n", err.Error())
+			} else {
+				if !reflect.DeepEqual(newCfg.Listen, cfg.Listen) || newCfg.UDPSize != cfg.UDPSize || newCfg.Metrics != cfg.Metrics {
+					logger.Infof("Warning: listen addresses, EDNS buffer size and metrics address are not changed until restart\n")
+				}
+				settings.Store(&newCfg)
+				logger.SetLevel(newCfg.LogLevel)
+				for _, warning := range newCfg.Warnings() {
+					logger.Infof("Warning: %s\n", warning)
+				}
+				logger.Infof("Config reloaded\n")
+			}
+			if err := servers.ReloadCertificates(); err != nil {
+				logger.Errorf("Failed to reload certificates: %s\n", err.Error())
+				continue
+			}
+			logger.Infof("Certificates reloaded\n")
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-stop
+		logger.Infof("Got %s, shutting down\n", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), settings.Load().ShutdownTimeout)
+		defer cancel()
+		if metrics != nil {
+			if err := metrics.Shutdown(ctx); err != nil {
+				logger.Errorf("Failed to stop metrics listener: %s\n", err.Error())
 			}
-			w.WriteMsg(m)
 		}
-	})
+		if err := servers.ShutdownContext(ctx); err != nil {
+			logger.Errorf("Failed to finish queries in flight: %s\n", err.Error())
+		}
+	}()
 
-	server := &dns.Server{Addr: cfg.Listen, Net: "udp"}
-	logger.Infof("Starting at %s\n", cfg.Listen)
-	err = server.ListenAndServe()
+	err = servers.Wait()
 	if err != nil {
-		logger.Errorf("Failed to start server: %s\n ", err.Error())
+		logger.Errorf("Server stopped: %s\n", err.Error())
+	}
+
+	dnsProxy = current.Load()
+	dnsProxy.Close()
+	if cacheFile := settings.Load().Cache.File; cacheFile != "" {
+		if err := dnsProxy.Cache.SaveFile(cacheFile); err != nil {
+			logger.Errorf("Failed to save cache: %s\n", err.Error())
+		}
 	}
 }
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"time"
+)
+
+// Cache hits and misses of upstream queries, published with the other expvar
+// variables at /debug/vars of the metrics listener
+var cacheStats = expvar.NewMap("cache")
+
+// Clients that don't send request headers in time are disconnected
+const metricsHeaderTimeout = 10 * time.Second
+
+// Serve expvar variables over HTTP until the returned server is shut down
+func serveMetrics(address string, logger *Log) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	server := &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: metricsHeaderTimeout}
+	go func() {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("Metrics listener stopped: %s\n", err.Error())
+		}
+	}()
+	return server
+}
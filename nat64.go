@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// NAT64 prefix of RFC 6052. Written as "prefix::/len", without length it is /96.
+// Prefix is an immutable value, so it is safe to share between queries.
+type NAT64Prefix struct {
+	netip.Prefix
+}
+
+func ParseNAT64Prefix(s string) (NAT64Prefix, error) {
+	var prefix netip.Prefix
+	if strings.Contains(s, "/") {
+		var err error
+		// Address is kept as written, so set host bits are reported by validation
+		prefix, err = netip.ParsePrefix(s)
+		if err != nil {
+			return NAT64Prefix{}, fmt.Errorf("invalid prefix %q", s)
+		}
+	} else {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return NAT64Prefix{}, fmt.Errorf("invalid prefix %q", s)
+		}
+		prefix = netip.PrefixFrom(addr, 96)
+	}
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return NAT64Prefix{}, fmt.Errorf("%s is not an IPv6 prefix", s)
+	}
+	return NAT64Prefix{prefix}, nil
+}
+
+func (p *NAT64Prefix) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	// Text that is not an IPv6 prefix is left unset, validation reports it with its path
+	*p, _ = ParseNAT64Prefix(s)
+	return nil
+}
+
+// Is prefix set, zones without prefix don't synthesize AAAA records
+func (p NAT64Prefix) IsSet() bool {
+	return p.IsValid()
+}
+
+// Byte positions of IPv4 octets after a prefix of bits length.
+// Bits 64-71 are the "u" octet, IPv4 octets skip it.
+func ipv4Positions(bits int) [4]int {
+	var pos [4]int
+	p := bits / 8
+	for i := range pos {
+		if p == 8 {
+			p++
+		}
+		pos[i] = p
+		p++
+	}
+	return pos
+}
+
+// IPv6 address with IPv4 one embedded after the prefix
+func (p NAT64Prefix) Embed(ipv4 netip.Addr) netip.Addr {
+	ip := p.Addr().As16()
+	octets := ipv4.As4()
+	for i, pos := range ipv4Positions(p.Bits()) {
+		ip[pos] = octets[i]
+	}
+	return netip.AddrFrom16(ip)
+}
+
+// IPv4 address embedded in IPv6 one. Addresses outside of the prefix have none,
+// as well as addresses with the "u" octet or the suffix not zero (RFC 6052 section 2.2)
+func (p NAT64Prefix) Extract(ip netip.Addr) (netip.Addr, bool) {
+	if !ip.Is6() || !p.Contains(ip) {
+		return netip.Addr{}, false
+	}
+	b := ip.As16()
+	positions := ipv4Positions(p.Bits())
+	for i := p.Bits() / 8; i < len(b); i++ {
+		if b[i] != 0 && !slices.Contains(positions[:], i) {
+			return netip.Addr{}, false
+		}
+	}
+	var octets [4]byte
+	for i, pos := range positions {
+		octets[i] = b[pos]
+	}
+	return netip.AddrFrom4(octets), true
+}
+
+// Zone prefixes, a single prefix or a list of them
+type NAT64Prefixes []NAT64Prefix
+
+func (p *NAT64Prefixes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single NAT64Prefix
+	if err := unmarshal(&single); err == nil {
+		*p = NAT64Prefixes{single}
+		return nil
+	}
+	var list []NAT64Prefix
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*p = list
+	return nil
+}
+
+// Are prefixes set, zones without prefix don't synthesize AAAA records
+func (p NAT64Prefixes) IsSet() bool {
+	return len(p) > 0
+}
+
+// Prefix chosen for key by rendezvous hashing. Removing a prefix
+// moves only keys that had it, the rest keep their prefixes.
+func (p NAT64Prefixes) pick(key []byte) NAT64Prefix {
+	var best NAT64Prefix
+	var bestScore uint64
+	for i, prefix := range p {
+		h := fnv.New64a()
+		h.Write([]byte(prefix.String()))
+		h.Write(key)
+		if score := mix64(h.Sum64()); i == 0 || score > bestScore {
+			best, bestScore = prefix, score
+		}
+	}
+	return best
+}
+
+// Murmur3 finalizer. FNV leaves high bits almost the same for keys differing in the last bytes
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Prefixes used to synthesize address of ipv4 for client
+func (p NAT64Prefixes) Select(mode PrefixSelect, ipv4 netip.Addr, client netip.Addr) NAT64Prefixes {
+	if len(p) < 2 {
+		return p
+	}
+	switch mode {
+	case HashIPv4Prefix:
+		return NAT64Prefixes{p.pick(ipv4.AsSlice())}
+	case HashClientPrefix:
+		return NAT64Prefixes{p.pick(client.Unmap().AsSlice())}
+	}
+	return p
+}
+
+// Longest prefix the address belongs to, with its embedded IPv4 address
+func (p NAT64Prefixes) Extract(ip netip.Addr) (netip.Addr, bool) {
+	var ipv4 netip.Addr
+	bits := -1
+	for _, prefix := range p {
+		if addr, ok := prefix.Extract(ip); ok && prefix.Bits() > bits {
+			ipv4, bits = addr, prefix.Bits()
+		}
+	}
+	return ipv4, bits >= 0
+}
+
+// How addresses are synthesized when a zone has several prefixes
+type PrefixSelect int
+
+const (
+	// Address of every prefix, clients choose one themselves
+	AllPrefixes PrefixSelect = iota
+	// One prefix chosen by hash of the IPv4 address
+	HashIPv4Prefix
+	// One prefix chosen by hash of the client address
+	HashClientPrefix
+)
+
+func (s PrefixSelect) String() string {
+	switch s {
+	case HashIPv4Prefix:
+		return "hash-ipv4"
+	case HashClientPrefix:
+		return "hash-client"
+	}
+	return "all"
+}
+
+func (s *PrefixSelect) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var mode string
+	if err := unmarshal(&mode); err != nil {
+		return err
+	}
+	switch strings.ToLower(mode) {
+	case "all":
+		*s = AllPrefixes
+	case "hash-ipv4":
+		*s = HashIPv4Prefix
+	case "hash-client":
+		*s = HashClientPrefix
+	default:
+		return fmt.Errorf("prefix-select must be one of 'all/hash-ipv4/hash-client'")
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestNAT64Prefix(t *testing.T) {
+	// Examples of RFC 6052 section 2.4
+	tests := []struct {
+		prefix   string
+		ipv4     string
+		expected string
+	}{
+		{"2001:db8::/32", "192.0.2.33", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "192.0.2.33", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "192.0.2.33", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "192.0.2.33", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "192.0.2.33", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "192.0.2.33", "2001:db8:122:344::192.0.2.33"},
+		{"2001:db8:122:344::", "192.0.2.33", "2001:db8:122:344::192.0.2.33"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			prefix, err := ParseNAT64Prefix(tt.prefix)
+			if err != nil {
+				t.Fatalf("ParseNAT64Prefix() error = %v", err)
+			}
+			if err := checkPrefix(prefix); err != nil {
+				t.Fatalf("checkPrefix() error = %v", err)
+			}
+			proxy := &DNSProxy{zones: Zones{{Name: "default", ZoneConfig: ZoneConfig{Prefix: NAT64Prefixes{prefix}}}}}
+
+			synthesized := proxy.MakeFakeIPs(net.ParseIP(tt.ipv4), "default", nil)
+			if len(synthesized) != 1 || !net.ParseIP(synthesized[0]).Equal(net.ParseIP(tt.expected)) {
+				t.Errorf("MakeFakeIPs() = %v, want %s", synthesized, tt.expected)
+			}
+
+			ptr, _ := dns.ReverseAddr(tt.expected)
+			ipv4, err := proxy.ReversePTR(ptr, "default")
+			if err != nil {
+				t.Fatalf("ReversePTR() error = %v", err)
+			}
+			if !ipv4.Equal(net.ParseIP(tt.ipv4)) {
+				t.Errorf("ReversePTR() = %s, want %s", ipv4, tt.ipv4)
+			}
+		})
+	}
+
+	proxy := &DNSProxy{zones: Zones{{Name: "default", ZoneConfig: ZoneConfig{Prefix: NAT64Prefixes{{netip.MustParsePrefix("2001:db8:122::/48")}}}}}}
+	for _, ptr := range []string{"33.2.0.192.in-addr.arpa.", "0.0.0.0.0.0.0.0.0.0.1.2.c.0.0.0.2.2.1.0.9.b.d.0.1.0.0.2.ip6.arpa."} {
+		if _, err := proxy.ReversePTR(ptr, "default"); err == nil {
+			t.Errorf("ReversePTR(%s) outside of the prefix succeeded", ptr)
+		}
+	}
+	// "u" octet and suffix are zero in synthesized addresses
+	for _, ip := range []string{"2001:db8:122:c000:102:2100::", "2001:db8:122:c000:2:2100::1"} {
+		ptr, _ := dns.ReverseAddr(ip)
+		if _, err := proxy.ReversePTR(ptr, "default"); err == nil {
+			t.Errorf("ReversePTR(%s) with non-zero u octet or suffix succeeded", ip)
+		}
+	}
+	for _, ip := range []net.IP{nil, net.ParseIP("2001:db8::1")} {
+		if ips := proxy.MakeFakeIPs(ip, "default", nil); len(ips) != 0 {
+			t.Errorf("MakeFakeIPs(%v) = %v, want none", ip, ips)
+		}
+	}
+
+	for _, s := range []string{"10.0.0.0", "10.0.0.0/8", "::ffff:10.0.0.0/96", "2001:db8::/"} {
+		if _, err := ParseNAT64Prefix(s); err == nil {
+			t.Errorf("ParseNAT64Prefix(%s) succeeded", s)
+		}
+	}
+	for _, s := range []string{"2001:db8::/80", "2001:db8::1/64", "2001:db8:0:0:100::/64"} {
+		prefix, err := ParseNAT64Prefix(s)
+		if err != nil {
+			t.Fatalf("ParseNAT64Prefix() error = %v", err)
+		}
+		if err := checkPrefix(prefix); err == nil {
+			t.Errorf("checkPrefix(%s) succeeded", s)
+		}
+	}
+}
+
+func TestPrefixSelect(t *testing.T) {
+	prefixes := NAT64Prefixes{
+		{netip.MustParsePrefix("300:dada:feda:f123:ff::/96")},
+		{netip.MustParsePrefix("300:baba:feda:f123::/64")},
+		{netip.MustParsePrefix("300:cafe::/32")},
+	}
+	proxy := &DNSProxy{zones: Zones{
+		{Name: "all", ZoneConfig: ZoneConfig{Prefix: prefixes}},
+		{Name: "ipv4", ZoneConfig: ZoneConfig{Prefix: prefixes, PrefixSelect: HashIPv4Prefix}},
+		{Name: "client", ZoneConfig: ZoneConfig{Prefix: prefixes, PrefixSelect: HashClientPrefix}},
+	}}
+
+	ipv4 := net.ParseIP("192.0.2.33")
+	if ips := proxy.MakeFakeIPs(ipv4, "all", nil); len(ips) != len(prefixes) {
+		t.Errorf("MakeFakeIPs() of all prefixes = %v, want %d addresses", ips, len(prefixes))
+	}
+
+	// Every prefix gets its share, the same key gets the same prefix
+	for _, zoneID := range []string{"ipv4", "client"} {
+		used := make(map[string]int)
+		for n := 0; n < 256; n++ {
+			ip := net.IPv4(10, 0, byte(n), 1)
+			ips := proxy.MakeFakeIPs(ip, zoneID, ip)
+			if len(ips) != 1 {
+				t.Fatalf("MakeFakeIPs() of %s = %v, want a single address", zoneID, ips)
+			}
+			if again := proxy.MakeFakeIPs(ip, zoneID, ip); again[0] != ips[0] {
+				t.Errorf("MakeFakeIPs() of %s = %s, then %s", zoneID, ips[0], again[0])
+			}
+			for _, prefix := range prefixes {
+				if prefix.Contains(netip.MustParseAddr(ips[0])) {
+					used[prefix.String()]++
+				}
+			}
+
+			ptr, _ := dns.ReverseAddr(ips[0])
+			if reversed, err := proxy.ReversePTR(ptr, zoneID); err != nil || !reversed.Equal(ip) {
+				t.Errorf("ReversePTR(%s) = %s, %v, want %s", ptr, reversed, err, ip)
+			}
+		}
+		if len(used) != len(prefixes) {
+			t.Errorf("Prefixes used by %s = %v, want all of them", zoneID, used)
+		}
+	}
+
+	// Removing a prefix keeps addresses of the others
+	client := netip.MustParseAddr("300:1::1")
+	for n := 0; n < 256; n++ {
+		key := []byte{10, 0, byte(n), 1}
+		chosen := prefixes.pick(key)
+		if chosen == prefixes[2] {
+			continue
+		}
+		if rest := prefixes[:2].pick(key); rest != chosen {
+			t.Errorf("pick(%v) = %s after removing a prefix, was %s", key, rest, chosen)
+		}
+	}
+	if selected := prefixes.Select(HashClientPrefix, netip.MustParseAddr("192.0.2.33"), client); len(selected) != 1 {
+		t.Errorf("Select() = %v, want a single prefix", selected)
+	}
+}
+
+func TestSynthesisConcurrent(t *testing.T) {
+	// Every name has its own A record: hostN.* is 10.0.N/256.N%256
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		var n int
+		if _, err := fmt.Sscanf(r.Question[0].Name, "host%d.", &n); err == nil && r.Question[0].Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 3600 IN A 10.0.%d.%d", r.Question[0].Name, n/256, n%256))
+			msg.Answer = append(msg.Answer, rr)
+		}
+		w.WriteMsg(msg)
+	}
+	_, serverAddr := startMockDNSServer(t, handler)
+
+	prefixes := []NAT64Prefix{
+		{netip.MustParsePrefix("300:dada:feda:f123:ff::/96")},
+		{netip.MustParsePrefix("2001:db8:122:344::/64")},
+	}
+	proxy, err := NewDNSProxy(Config{
+		Default: ForwarderConfig{Upstreams: upstreamAddrs(serverAddr)},
+		Zones: Zones{
+			{Name: "wide", ZoneConfig: ZoneConfig{Domains: []string{"wide.test"}, Prefix: NAT64Prefixes{prefixes[1]}}},
+			{Name: "default", ZoneConfig: ZoneConfig{Domains: []string{"."}, Prefix: NAT64Prefixes{prefixes[0]}}},
+		},
+	}, New(time.Minute, 0))
+	if err != nil {
+		t.Fatalf("NewDNSProxy() error = %v", err)
+	}
+	defer proxy.Close()
+
+	// Many names are resolved by a few workers at once, so the mock server keeps up
+	const names, workers = 500, 16
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	errs := make(chan error, names)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range jobs {
+				name, prefix := fmt.Sprintf("host%d.test.", n), prefixes[0]
+				if n%2 == 1 {
+					name, prefix = fmt.Sprintf("host%d.wide.test.", n), prefixes[1]
+				}
+				query := new(dns.Msg)
+				query.SetQuestion(name, dns.TypeAAAA)
+				resp, err := proxy.getResponse(query, nil)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				expected := prefix.Embed(netip.AddrFrom4([4]byte{10, 0, byte(n / 256), byte(n % 256)}))
+				if len(resp.Answer) != 1 || resp.Answer[0].(*dns.AAAA).AAAA.String() != expected.String() {
+					errs <- fmt.Errorf("%s answer = %v, want %s", name, resp.Answer, expected)
+				}
+			}
+		}()
+	}
+	for n := 0; n < names; n++ {
+		jobs <- n
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if prefixes[0].Addr() != netip.MustParseAddr("300:dada:feda:f123:ff::") {
+		t.Errorf("Prefix is modified by synthesis: %s", prefixes[0])
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Cache of the config settings
+func cacheFromConfig(cfg Config) *Cache {
+	return NewBounded(cfg.Cache.ExpTime*time.Minute, cfg.Cache.PurgeTime*time.Minute, cfg.Cache.MaxItems, cfg.Cache.MaxBytes)
+}
+
+// Read config file again and switch to a proxy built from it.
+// If the config is invalid, the current proxy is kept. The old proxy
+// is closed after queries it is serving are finished. Listen addresses,
+// EDNS buffer size and metrics address are kept until restart.
+func reloadConfig(fileName string, current *atomic.Pointer[DNSProxy]) (Config, error) {
+	cfg, err := parseFile(fileName)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+
+	old := current.Load()
+	cache := old.Cache
+	if !cfg.Cache.KeepOnReload {
+		cache = cacheFromConfig(*cfg)
+	} else if maxItems, maxBytes := cache.Limits(); maxItems != cfg.Cache.MaxItems || maxBytes != cfg.Cache.MaxBytes {
+		// Kept answers are moved to a cache with the new limits
+		cache = cacheFromConfig(*cfg)
+		old.Cache.CopyTo(cache)
+	}
+	proxy, err := NewDNSProxy(*cfg, cache)
+	if err != nil {
+		return Config{}, err
+	}
+
+	current.Store(proxy)
+	old.CloseWhenIdle()
+	return *cfg, nil
+}
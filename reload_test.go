@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func writeTestConfig(t *testing.T, fileName string, upstream string, static string, keepCache bool) {
+	body := `
+listen: "127.0.0.1:53"
+default: "` + upstream + `"
+zones:
+  default:
+    domains:
+      - "."
+    prefix: "300:dada:feda:f123:ff::"
+static:
+  host.test: "` + static + `"
+cache:
+  keep-on-reload: ` + strconv.FormatBool(keepCache) + `
+`
+	if err := os.WriteFile(fileName, []byte(body), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+}
+
+func loadTestProxy(t *testing.T, fileName string) *atomic.Pointer[DNSProxy] {
+	cfg, err := parseFile(fileName)
+	if err != nil {
+		t.Fatalf("parseFile() error = %v", err)
+	}
+	proxy, err := NewDNSProxy(*cfg, cacheFromConfig(*cfg))
+	if err != nil {
+		t.Fatalf("NewDNSProxy() error = %v", err)
+	}
+	current := new(atomic.Pointer[DNSProxy])
+	current.Store(proxy)
+	t.Cleanup(func() { current.Load().Close() })
+	return current
+}
+
+func queryStatic(t *testing.T, proxy *DNSProxy) string {
+	query := new(dns.Msg)
+	query.SetQuestion("host.test.", dns.TypeAAAA)
+	resp, err := proxy.getResponse(query, nil)
+	if err != nil {
+		t.Fatalf("getResponse() error = %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("getResponse() answer length = %d, want 1", len(resp.Answer))
+	}
+	return resp.Answer[0].(*dns.AAAA).AAAA.String()
+}
+
+func TestReloadConfig(t *testing.T) {
+	upstream := startMockUpstream(t, "10.0.0.1", 0, nil)
+	fileName := filepath.Join(t.TempDir(), "config.yml")
+
+	tests := []struct {
+		name      string
+		keepCache bool
+	}{
+		{"Cache is flushed", false},
+		{"Cache is kept", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeTestConfig(t, fileName, upstream, "10.0.0.1", tt.keepCache)
+			current := loadTestProxy(t, fileName)
+			if result := queryStatic(t, current.Load()); result != "300:dada:feda:f123:ff:0:a00:1" {
+				t.Fatalf("Static address before reload = %s", result)
+			}
+
+			oldCache := current.Load().Cache
+
+			writeTestConfig(t, fileName, upstream, "10.0.0.2", tt.keepCache)
+			if _, err := reloadConfig(fileName, current); err != nil {
+				t.Fatalf("reloadConfig() error = %v", err)
+			}
+			// Static addresses are config, they are never served from cache
+			if result := queryStatic(t, current.Load()); result != "300:dada:feda:f123:ff:0:a00:2" {
+				t.Errorf("Static address after reload = %s, want 300:dada:feda:f123:ff:0:a00:2", result)
+			}
+			if kept := current.Load().Cache == oldCache; kept != tt.keepCache {
+				t.Errorf("Cache is kept = %v, want %v", kept, tt.keepCache)
+			}
+		})
+	}
+
+	// Kept answers are moved to a cache with new limits
+	writeTestConfig(t, fileName, upstream, "10.0.0.1", true)
+	current := loadTestProxy(t, fileName)
+	current.Load().Cache.Set("kept", "kept", time.Minute)
+	body, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if err := os.WriteFile(fileName, append(body, "  max-items: 10\n"...), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := reloadConfig(fileName, current); err != nil {
+		t.Fatalf("reloadConfig() error = %v", err)
+	}
+	if maxItems, _ := current.Load().Cache.Limits(); maxItems != 10 {
+		t.Errorf("Cache max-items after reload = %d, want 10", maxItems)
+	}
+	if _, found := current.Load().Cache.Get("kept"); !found {
+		t.Errorf("Kept answer is not copied to the new cache")
+	}
+
+	// Invalid config keeps the old one
+	writeTestConfig(t, fileName, upstream, "10.0.0.1", false)
+	current = loadTestProxy(t, fileName)
+	old := current.Load()
+	if err := os.WriteFile(fileName, []byte("zones: [broken"), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := reloadConfig(fileName, current); err == nil {
+		t.Errorf("reloadConfig() of broken config succeeded")
+	}
+	if err := os.WriteFile(fileName, []byte("zones:\n  default:\n    domains: [\".\"]\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := reloadConfig(fileName, current); err == nil {
+		t.Errorf("reloadConfig() of config without prefix succeeded")
+	}
+	if current.Load() != old {
+		t.Errorf("Proxy is replaced by invalid config")
+	}
+}
+
+func TestReloadInFlight(t *testing.T) {
+	upstream := startMockUpstream(t, "10.0.0.1", 200*time.Millisecond, nil)
+	fileName := filepath.Join(t.TempDir(), "config.yml")
+	writeTestConfig(t, fileName, upstream, "10.0.0.1", false)
+	current := loadTestProxy(t, fileName)
+
+	listeners := Listeners{{Address: "127.0.0.1:0", Protocol: "udp"}}
+	servers, err := startServers(listeners, newHandler(current, NewLogger("err")))
+	if err != nil {
+		t.Fatalf("startServers() error = %v", err)
+	}
+	defer servers.Shutdown()
+
+	answered := make(chan error, 1)
+	go func() {
+		query := new(dns.Msg)
+		query.SetQuestion("who.test.", dns.TypeAAAA)
+		client := &dns.Client{Timeout: time.Second}
+		resp, _, err := client.Exchange(query, servers.Addrs()[0].String())
+		if err == nil && len(resp.Answer) != 1 {
+			err = fmt.Errorf("answer length = %d, want 1", len(resp.Answer))
+		}
+		answered <- err
+	}()
+
+	// Reload while the query waits for the upstream
+	time.Sleep(50 * time.Millisecond)
+	if _, err := reloadConfig(fileName, current); err != nil {
+		t.Fatalf("reloadConfig() error = %v", err)
+	}
+	if err := <-answered; err != nil {
+		t.Errorf("Query in flight failed: %v", err)
+	}
+}
+
+func TestAcquireReplacedProxy(t *testing.T) {
+	old, proxy := new(DNSProxy), new(DNSProxy)
+	var current atomic.Pointer[DNSProxy]
+	current.Store(old)
+
+	// Query in flight keeps the replaced proxy from being closed
+	old.active.RLock()
+	current.Store(proxy)
+	closed := make(chan struct{})
+	go func() {
+		old.active.Lock()
+		close(closed)
+		old.active.Unlock()
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	acquired := make(chan *DNSProxy, 1)
+	go func() { acquired <- acquireProxy(&current) }()
+	select {
+	case p := <-acquired:
+		if p != proxy {
+			t.Errorf("acquireProxy() returned the replaced proxy")
+		}
+		p.active.RUnlock()
+	case <-time.After(time.Second):
+		t.Errorf("acquireProxy() waits for the replaced proxy")
+	}
+	old.active.RUnlock()
+	<-closed
+}
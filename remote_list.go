@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultListsRefresh = time.Hour
+	defaultListsTimeout = 30 * time.Second
+	maxListSize         = 64 << 20
+)
+
+// Local copy of a remote list. Domains are read from it like from a domains file
+func listFile(dir string, listURL string) string {
+	sum := sha256.Sum256([]byte(listURL))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+".txt")
+}
+
+// Validators of the local copy, sent back to the server to skip unchanged lists
+type listMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last-modified,omitempty"`
+}
+
+func readListMeta(fileName string) listMeta {
+	var meta listMeta
+	if body, err := os.ReadFile(fileName + ".meta"); err == nil {
+		json.Unmarshal(body, &meta)
+	}
+	return meta
+}
+
+// Write file at once, readers see either the old or the new content
+func writeFileAtomic(fileName string, body []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// Download list if it has changed since the local copy was saved. Invalid lines
+// don't stop the list from being saved, they are skipped and reported when zones are rebuilt.
+func fetchList(ctx context.Context, client *http.Client, dir string, listURL string) (changed bool, err error) {
+	fileName := listFile(dir, listURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, listURL, nil)
+	if err != nil {
+		return false, err
+	}
+	meta := readListMeta(fileName)
+	if _, err := os.Stat(fileName); err == nil && meta.URL == listURL {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxListSize+1))
+	if err != nil {
+		return false, err
+	}
+	if len(body) > maxListSize {
+		return false, fmt.Errorf("list is larger than %d bytes", maxListSize)
+	}
+	if _, _, err := parseDomains(bytes.NewReader(body)); err != nil {
+		return false, err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return false, err
+	}
+	if err := writeFileAtomic(fileName, body); err != nil {
+		return false, err
+	}
+	meta = listMeta{URL: listURL, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	metaBody, _ := json.Marshal(meta)
+	if err := writeFileAtomic(fileName+".meta", metaBody); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Remote lists of all zones
+func listURLs(zones Zones) []string {
+	var urls []string
+	for _, zone := range zones {
+		urls = append(urls, zone.DomainsURLs...)
+	}
+	return urls
+}
+
+// Remote lists of all zones, views included
+func (c *Config) listURLs() []string {
+	urls := listURLs(c.Zones)
+	for _, view := range c.Views {
+		urls = append(urls, listURLs(view.Zones)...)
+	}
+	return urls
+}
+
+// HTTP client for remote lists. List hosts are resolved through the forwarders:
+// the system resolver may be this proxy, not serving yet.
+func (proxy *DNSProxy) newListsClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, address)
+		}
+		ips, err := proxy.resolveHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			var conn net.Conn
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// Addresses of host from the forwarder of its domain, IPv4 ones first
+func (proxy *DNSProxy) resolveHost(ctx context.Context, host string) ([]net.IP, error) {
+	name := dns.Fqdn(host)
+	forwarder := proxy.getForwarder(name)
+	if forwarder == nil {
+		return nil, fmt.Errorf("no forwarder to resolve %s", host)
+	}
+	var ips []net.IP
+	var err error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		var resp *dns.Msg
+		if resp, err = forwarder.ExchangeContext(ctx, m); err != nil {
+			continue
+		}
+		for _, rr := range resp.Answer {
+			switch a := rr.(type) {
+			case *dns.A:
+				ips = append(ips, a.A)
+			case *dns.AAAA:
+				ips = append(ips, a.AAAA)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %w", host, err)
+		}
+		return nil, fmt.Errorf("no addresses of %s", host)
+	}
+	return ips, nil
+}
+
+// Download remote lists now and then every interval, rebuilding zones when they change.
+// Unchanged lists are not downloaded again, the server answers 304 to their ETag.
+func (proxy *DNSProxy) refreshLists(client *http.Client, interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-proxy.stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		proxy.fetchLists(ctx, client)
+		select {
+		case <-proxy.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (proxy *DNSProxy) fetchLists(ctx context.Context, client *http.Client) {
+	changed := false
+	for _, listURL := range listURLs(proxy.zones) {
+		c, err := fetchList(ctx, client, proxy.listsDir, listURL)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			proxy.logger.Errorf("Failed to download %s, keeping the last copy: %s\n", listURL, err.Error())
+			continue
+		}
+		changed = changed || c
+	}
+	if !changed {
+		return
+	}
+	if err := proxy.reloadZones(); err != nil {
+		proxy.logger.Errorf("Failed to reload domains lists: %s\n", err.Error())
+		return
+	}
+	proxy.logger.Infof("Domains lists refreshed\n")
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// List server answering 304 to requests with the current ETag
+type mockListServer struct {
+	mu          sync.Mutex
+	body        string
+	etag        string
+	fail        bool
+	notModified int
+}
+
+func (s *mockListServer) set(body string, etag string, fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.body, s.etag, s.fail = body, etag, fail
+}
+
+func (s *mockListServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		http.Error(w, "broken", http.StatusInternalServerError)
+		return
+	}
+	if r.Header.Get("If-None-Match") == s.etag {
+		s.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", s.etag)
+	w.Write([]byte(s.body))
+}
+
+func waitZoneID(t *testing.T, proxy *DNSProxy, domain string, expected string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for proxy.getZoneID(domain) != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("getZoneID(%s) = %s after refresh, want %s", domain, proxy.getZoneID(domain), expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRemoteLists(t *testing.T) {
+	lists := &mockListServer{body: "# Blocked\nexample.com\n", etag: `"v1"`}
+	server := httptest.NewServer(lists)
+	defer server.Close()
+
+	dir := t.TempDir()
+	cfg := Config{
+		Zones: Zones{
+			{Name: "nat64", ZoneConfig: ZoneConfig{DomainsURLs: stringList{server.URL + "/blocked.txt"}}},
+			{Name: "default", ZoneConfig: ZoneConfig{Domains: []string{"."}}},
+		},
+	}
+	cfg.RemoteLists.Dir = dir
+	cfg.RemoteLists.Refresh = 10 * time.Millisecond
+
+	proxy, err := NewDNSProxy(cfg, nil)
+	if err != nil {
+		t.Fatalf("NewDNSProxy() error = %v", err)
+	}
+	defer proxy.Close()
+	waitZone := func(domain string, expected string) {
+		t.Helper()
+		waitZoneID(t, proxy, domain, expected)
+	}
+	// List is downloaded in the background
+	waitZone("www.example.com.", "nat64")
+
+	// Unchanged list is not downloaded again
+	time.Sleep(50 * time.Millisecond)
+	lists.mu.Lock()
+	notModified := lists.notModified
+	lists.mu.Unlock()
+	if notModified == 0 {
+		t.Errorf("Refresh doesn't send ETag of the saved copy")
+	}
+
+	// Changed list is applied
+	lists.set("example.org\n", `"v2"`, false)
+	waitZone("example.org.", "nat64")
+	waitZone("example.com.", "default")
+
+	// Failed downloads keep the last good copy
+	lists.set("", `"v3"`, true)
+	time.Sleep(50 * time.Millisecond)
+	if zoneID := proxy.getZoneID("example.org."); zoneID != "nat64" {
+		t.Errorf("getZoneID() after failed refresh = %s, want nat64", zoneID)
+	}
+
+	// Invalid lines are skipped, the rest of the list is used
+	lists.set("broken_domain!\nexample.net\nexample.org\n", `"v4"`, false)
+	waitZone("example.net.", "nat64")
+	proxy.Close()
+
+	// Saved copy is used when the server is down on start
+	server.Close()
+	proxy, err = NewDNSProxy(cfg, nil)
+	if err != nil {
+		t.Fatalf("NewDNSProxy() with server down error = %v", err)
+	}
+	defer proxy.Close()
+	if zoneID := proxy.getZoneID("example.org."); zoneID != "nat64" {
+		t.Errorf("getZoneID() from saved copy = %s, want nat64", zoneID)
+	}
+}
+
+func TestRemoteListsStartup(t *testing.T) {
+	lists := &mockListServer{body: "example.org\n", etag: `"v2"`}
+	server := httptest.NewServer(lists)
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	listURL := "http://lists.test:" + port + "/list.txt"
+
+	// List host is resolved by the forwarder, not the system resolver
+	_, upstream := startMockDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA && r.Question[0].Name == "lists.test." {
+			rr, _ := dns.NewRR("lists.test. 60 IN A 127.0.0.1")
+			msg.Answer = append(msg.Answer, rr)
+		}
+		w.WriteMsg(msg)
+	})
+
+	// Copy saved by the previous run
+	dir := t.TempDir()
+	fileName := listFile(dir, listURL)
+	if err := os.WriteFile(fileName, []byte("example.com\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write list copy: %v", err)
+	}
+	meta, _ := json.Marshal(listMeta{URL: listURL, ETag: `"v1"`})
+	if err := os.WriteFile(fileName+".meta", meta, 0o600); err != nil {
+		t.Fatalf("Failed to write list meta: %v", err)
+	}
+
+	cfg := Config{
+		Default: ForwarderConfig{Upstreams: upstreamAddrs(upstream)},
+		Zones: Zones{
+			{Name: "nat64", ZoneConfig: ZoneConfig{DomainsURLs: stringList{listURL}}},
+			{Name: "default", ZoneConfig: ZoneConfig{Domains: []string{"."}}},
+		},
+		WatchInterval: time.Hour,
+	}
+	cfg.RemoteLists.Dir = dir
+	cfg.RemoteLists.Refresh = time.Hour
+
+	proxy, err := NewDNSProxy(cfg, nil)
+	if err != nil {
+		t.Fatalf("NewDNSProxy() error = %v", err)
+	}
+	defer proxy.Close()
+	// Copy is refreshed on start, not after the first refresh interval
+	waitZoneID(t, proxy, "example.org.", "nat64")
+	waitZoneID(t, proxy, "example.com.", "default")
+	proxy.zonesMu.Lock()
+	if len(proxy.zoneFiles) != 0 {
+		t.Errorf("Copies of remote lists are watched as domains files: %v", proxy.zoneFiles)
+	}
+	proxy.zonesMu.Unlock()
+}
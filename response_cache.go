@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream response with its records. Zones rewrite it every time it is served,
+// so one response serves all zones and clients. NXDOMAIN and NODATA responses
+// keep the SOA they came with in Ns (RFC 2308).
+type cachedResponse struct {
+	Rcode   int
+	Answer  rrSet
+	Ns      rrSet
+	Extra   rrSet
+	TTL     time.Duration // How long the response is fresh
+	Expires time.Time     // Then it is stale until the cache item expires
+	hits    *responseHits // Shared by copies of the response, not saved
+}
+
+// Fresh hits of a cached response, counted for prefetching
+type responseHits struct {
+	count       atomic.Int64
+	prefetching atomic.Bool
+}
+
+// Cached response refreshed in the background
+type prefetchRequest struct {
+	key       string
+	forwarder *Forwarder
+	query     *dns.Msg
+	hits      *responseHits
+}
+
+// Requests over this are dropped until the worker catches up, the names expire as usual then
+const prefetchQueueSize = 64
+
+// Client response timer of RFC 8767: stale answer is served if the upstream is slower
+const staleAnswerTimeout = 1800 * time.Millisecond
+
+// Responses are cached for each view, name, class and type
+func (proxy *DNSProxy) cacheKey(q *dns.Question) string {
+	return proxy.view + "/" + strings.ToLower(q.Name) + " " + dns.ClassToString[q.Qclass] + " " + dns.TypeToString[q.Qtype]
+}
+
+// Key of the response to query m. Responses to DO queries carry DNSSEC records
+// and CD ones are not validated upstream, so they are cached apart from plain ones.
+func (proxy *DNSProxy) queryKey(m *dns.Msg) string {
+	key := proxy.cacheKey(&m.Question[0])
+	if opt := m.IsEdns0(); opt != nil && opt.Do() {
+		key += " DO"
+	}
+	if m.CheckingDisabled {
+		key += " CD"
+	}
+	return key
+}
+
+func (proxy *DNSProxy) cacheEnabled() bool {
+	return proxy.Cache != nil && !proxy.noCache
+}
+
+// Upstream query through the response cache
+func (proxy *DNSProxy) exchange(forwarder *Forwarder, m *dns.Msg) (*dns.Msg, error) {
+	return proxy.exchangeContext(context.Background(), forwarder, m)
+}
+
+// Same as exchange, aborting the query when ctx is done. Expired responses
+// within cache stale-ttl are served when the upstream fails or doesn't answer
+// within staleAnswerTimeout, the query goes on then and refreshes the cache (RFC 8767).
+func (proxy *DNSProxy) exchangeContext(ctx context.Context, forwarder *Forwarder, m *dns.Msg) (*dns.Msg, error) {
+	if len(m.Question) == 0 || !proxy.cacheEnabled() {
+		return forwarder.ExchangeContext(ctx, m)
+	}
+	q := m.Question[0]
+	key := proxy.queryKey(m)
+	response, found := proxy.cachedResponse(key)
+	if left := time.Until(response.Expires); found && left > 0 {
+		cacheStats.Add("hits", 1)
+		proxy.logger.Debugf("Cache hit %s %s\n", q.Name, dns.TypeToString[q.Qtype])
+		proxy.countHit(key, forwarder, m, response, left)
+		return response.msg(m, left), nil
+	}
+	cacheStats.Add("misses", 1)
+	proxy.logger.Debugf("Cache miss %s %s\n", q.Name, dns.TypeToString[q.Qtype])
+
+	if !found {
+		msg, err := forwarder.ExchangeContext(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+		proxy.cacheResponse(key, msg)
+		return msg, nil
+	}
+
+	type result struct {
+		msg *dns.Msg
+		err error
+	}
+	done := make(chan result, 1)
+	query := m.Copy()
+	go func() {
+		// Not canceled with the client query, the answer refreshes the cache
+		msg, err := forwarder.ExchangeContext(context.WithoutCancel(ctx), query)
+		if err == nil {
+			proxy.cacheResponse(key, msg)
+		}
+		done <- result{msg, err}
+	}()
+	timer := time.NewTimer(proxy.staleAnswerTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		if !upstreamFailed(r.msg, r.err) {
+			return r.msg, nil
+		}
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	cacheStats.Add("stale", 1)
+	proxy.logger.Debugf("Serving stale %s %s\n", q.Name, dns.TypeToString[q.Qtype])
+	return response.msg(m, proxy.staleAnswerTTL), nil
+}
+
+// Upstream gave no answer worth serving instead of a stale one
+func upstreamFailed(msg *dns.Msg, err error) bool {
+	return err != nil || msg.Rcode == dns.RcodeServerFailure || msg.Rcode == dns.RcodeRefused
+}
+
+// Cache response. Records get the TTL the response is cached for,
+// the response is kept for cache stale-ttl more after it expires.
+// Returns false if the response is not cacheable.
+func (proxy *DNSProxy) cacheResponse(key string, msg *dns.Msg) bool {
+	ttl := proxy.responseTTL(msg)
+	if ttl < time.Second {
+		return false
+	}
+	cached := cachedResponse{
+		Rcode:   msg.Rcode,
+		Answer:  cachedRecords(msg.Answer, ttl),
+		Ns:      cachedRecords(msg.Ns, ttl),
+		Extra:   cachedRecords(msg.Extra, ttl),
+		TTL:     ttl,
+		Expires: time.Now().Add(ttl),
+		hits:    new(responseHits),
+	}
+	proxy.Cache.Set(key, cached, ttl+proxy.staleTTL)
+	return true
+}
+
+// Copies of records with ttl. OPT belongs to the message, not to the answer, and is left out
+func cachedRecords(records []dns.RR, ttl time.Duration) rrSet {
+	cached := make(rrSet, 0, len(records))
+	for _, rr := range records {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = uint32(ttl / time.Second)
+		cached = append(cached, rr)
+	}
+	return cached
+}
+
+// Cached response, fresh or stale
+func (proxy *DNSProxy) cachedResponse(key string) (cachedResponse, bool) {
+	cached, expiration, found := proxy.Cache.GetWithExpiration(key)
+	if !found {
+		return cachedResponse{}, false
+	}
+	response, ok := cached.(cachedResponse)
+	if !ok {
+		return cachedResponse{}, false
+	}
+	// Saved by a version without stale responses
+	if response.Expires.IsZero() {
+		response.Expires = expiration
+	}
+	return response, true
+}
+
+// Response to query m with records TTL up to ttl
+func (r cachedResponse) msg(m *dns.Msg, ttl time.Duration) *dns.Msg {
+	// Rounded up, so records aren't served with zero TTL before they expire
+	seconds := uint32((ttl + time.Second - 1) / time.Second)
+	q := &m.Question[0]
+	msg := new(dns.Msg)
+	msg.SetRcode(m, r.Rcode)
+	msg.Answer = servedRecords(r.Answer, seconds, q)
+	msg.Ns = servedRecords(r.Ns, seconds, q)
+	msg.Extra = servedRecords(r.Extra, seconds, q)
+	return msg
+}
+
+// Count fresh hit of response and queue its refresh when it is popular
+// and has less than a tenth of its TTL left
+func (proxy *DNSProxy) countHit(key string, forwarder *Forwarder, m *dns.Msg, r cachedResponse, left time.Duration) {
+	if proxy.prefetchQueue == nil || r.hits == nil {
+		return
+	}
+	hits := r.hits.count.Add(1)
+	if hits < proxy.prefetchHits || left > r.TTL/10 || !r.hits.prefetching.CompareAndSwap(false, true) {
+		return
+	}
+	query := m.Copy()
+	query.Id = dns.Id()
+	select {
+	case proxy.prefetchQueue <- prefetchRequest{key: key, forwarder: forwarder, query: query, hits: r.hits}:
+	default:
+		r.hits.prefetching.Store(false)
+	}
+}
+
+// Refresh queued responses until the proxy is closed
+func (proxy *DNSProxy) prefetchWorker() {
+	for {
+		select {
+		case r := <-proxy.prefetchQueue:
+			proxy.prefetch(r)
+		case <-proxy.stop:
+			return
+		}
+	}
+}
+
+func (proxy *DNSProxy) prefetch(r prefetchRequest) {
+	// Forwarders are closed with the proxy once queries in flight are finished
+	proxy.active.RLock()
+	defer proxy.active.RUnlock()
+	q := r.query.Question[0]
+	select {
+	case <-proxy.stop:
+		return
+	default:
+	}
+	msg, err := r.forwarder.Exchange(r.query)
+	if err == nil && proxy.cacheResponse(r.key, msg) {
+		cacheStats.Add("prefetches", 1)
+		proxy.logger.Debugf("Prefetched %s %s\n", q.Name, dns.TypeToString[q.Qtype])
+		return
+	}
+	// Cached response is served until it expires, the next hit tries again
+	proxy.logger.Debugf("Prefetch of %s %s failed\n", q.Name, dns.TypeToString[q.Qtype])
+	r.hits.prefetching.Store(false)
+}
+
+// Copies of cached records with TTL lowered to ttl
+func servedRecords(records []dns.RR, ttl uint32, q *dns.Question) []dns.RR {
+	served := make([]dns.RR, 0, len(records))
+	for _, rr := range records {
+		rr = dns.Copy(rr)
+		if ttl < rr.Header().Ttl {
+			rr.Header().Ttl = ttl
+		}
+		// Owner name is written the way the client asked for it
+		if strings.EqualFold(rr.Header().Name, q.Name) {
+			rr.Header().Name = q.Name
+		}
+		served = append(served, rr)
+	}
+	return served
+}
+
+// How long response is cached. Answers are cached for their lowest record TTL
+// within cache min-ttl and max-ttl. NXDOMAIN and NODATA are cached for SOA TTL
+// or minimum, whichever is lower, up to cache negative-max-ttl. Negative answers
+// without SOA, failures and truncated responses are not cached.
+func (proxy *DNSProxy) responseTTL(msg *dns.Msg) time.Duration {
+	if msg.Truncated || msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return 0
+	}
+	if msg.Rcode == dns.RcodeNameError || len(msg.Answer) == 0 {
+		return proxy.negativeTTL(msg)
+	}
+
+	ttl := time.Duration(-1)
+	for _, records := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range records {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if d := time.Duration(rr.Header().Ttl) * time.Second; ttl < 0 || d < ttl {
+				ttl = d
+			}
+		}
+	}
+	if ttl < proxy.minTTL {
+		ttl = proxy.minTTL
+	}
+	if proxy.maxTTL > 0 && ttl > proxy.maxTTL {
+		ttl = proxy.maxTTL
+	}
+	return ttl
+}
+
+func (proxy *DNSProxy) negativeTTL(msg *dns.Msg) time.Duration {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+			if proxy.negativeMaxTTL > 0 && ttl > proxy.negativeMaxTTL {
+				ttl = proxy.negativeMaxTTL
+			}
+			// CNAME records leading to the name don't outlive their TTL
+			for _, rr := range msg.Answer {
+				ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+			}
+			return ttl
+		}
+	}
+	return 0
+}
+
+// Memory taken by records, roughly: their wire size and the structs around it
+func (s rrSet) Size() int {
+	size := 0
+	for _, rr := range s {
+		size += dns.Len(rr) + 64
+	}
+	return size
+}
+
+func (r cachedResponse) Size() int {
+	return r.Answer.Size() + r.Ns.Size() + r.Extra.Size()
+}
+
+// Cached records. Gob can't encode dns.RR types, so records are saved in wire format
+type rrSet []dns.RR
+
+func init() {
+	gob.Register(rrSet{})
+	gob.Register(cachedResponse{})
+}
+
+// Responses loaded from the cache file get their hit counter, it isn't saved
+func (r cachedResponse) loaded() interface{} {
+	r.hits = new(responseHits)
+	return r
+}
+
+func (s rrSet) GobEncode() ([]byte, error) {
+	m := &dns.Msg{Answer: s}
+	return m.Pack()
+}
+
+func (s *rrSet) GobDecode(b []byte) error {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return err
+	}
+	*s = m.Answer
+	return nil
+}
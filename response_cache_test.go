@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestResponseTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttls     []uint32
+		min, max time.Duration
+		expected time.Duration
+	}{
+		{"Lowest record TTL", []uint32{300, 60, 3600}, 0, 0, time.Minute},
+		{"Raised to min-ttl", []uint32{5}, 30 * time.Second, time.Hour, 30 * time.Second},
+		{"Lowered to max-ttl", []uint32{86400}, 0, time.Hour, time.Hour},
+		{"Zero TTL", []uint32{0, 300}, 0, time.Hour, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := &DNSProxy{minTTL: tt.min, maxTTL: tt.max}
+			msg := new(dns.Msg)
+			for i, ttl := range tt.ttls {
+				rr, _ := dns.NewRR("host.test. IN A 10.0.0.1")
+				rr.Header().Ttl = ttl
+				// Records of all sections count
+				if i == len(tt.ttls)-1 && i > 0 {
+					msg.Extra = append(msg.Extra, rr)
+					continue
+				}
+				msg.Answer = append(msg.Answer, rr)
+			}
+			// OPT TTL holds flags, not TTL
+			msg.SetEdns0(1232, true)
+			if ttl := proxy.responseTTL(msg); ttl != tt.expected {
+				t.Errorf("responseTTL() = %s, want %s", ttl, tt.expected)
+			}
+		})
+	}
+
+	msg := new(dns.Msg)
+	msg.Rcode = dns.RcodeServerFailure
+	if ttl := (&DNSProxy{minTTL: time.Minute}).responseTTL(msg); ttl != 0 {
+		t.Errorf("responseTTL() of SERVFAIL = %s, want 0", ttl)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	proxy := &DNSProxy{}
+	view := &DNSProxy{view: "lan"}
+	q := &dns.Question{Name: "Host.Test.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}
+	key := proxy.cacheKey(q)
+
+	if other := proxy.cacheKey(&dns.Question{Name: "host.test.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}); other != key {
+		t.Errorf("cacheKey() differs by name case: %q and %q", key, other)
+	}
+	for _, other := range []string{
+		proxy.cacheKey(&dns.Question{Name: "host.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}),
+		proxy.cacheKey(&dns.Question{Name: "host.test.", Qtype: dns.TypeAAAA, Qclass: dns.ClassCHAOS}),
+		view.cacheKey(q),
+	} {
+		if other == key {
+			t.Errorf("cacheKey() = %q for different questions", key)
+		}
+	}
+}
+
+func TestQueryKey(t *testing.T) {
+	proxy := &DNSProxy{}
+	plain := new(dns.Msg)
+	plain.SetQuestion("host.test.", dns.TypeAAAA)
+	if key := proxy.queryKey(plain); key != proxy.cacheKey(&plain.Question[0]) {
+		t.Errorf("queryKey() of plain query = %q", key)
+	}
+	edns := plain.Copy().SetEdns0(dns.DefaultMsgSize, false)
+	if key := proxy.queryKey(edns); key != proxy.cacheKey(&plain.Question[0]) {
+		t.Errorf("queryKey() of EDNS query without DO = %q", key)
+	}
+	do := plain.Copy().SetEdns0(dns.DefaultMsgSize, true)
+	cd := plain.Copy()
+	cd.CheckingDisabled = true
+	both := do.Copy()
+	both.CheckingDisabled = true
+	keys := map[string]bool{proxy.queryKey(plain): true}
+	for _, m := range []*dns.Msg{do, cd, both} {
+		key := proxy.queryKey(m)
+		if keys[key] {
+			t.Errorf("queryKey() = %q for queries with different DO and CD bits", key)
+		}
+		keys[key] = true
+	}
+}
+
+func TestCachedResponse(t *testing.T) {
+	var queries atomic.Int32
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		switch r.Question[0].Qtype {
+		case dns.TypeA:
+			rr, _ := dns.NewRR(r.Question[0].Name + " 120 IN A 10.0.0.1")
+			msg.Answer = append(msg.Answer, rr)
+		case dns.TypeMX:
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN MX 10 mail.test.")
+			glue, _ := dns.NewRR("mail.test. 300 IN A 10.0.0.2")
+			msg.Answer = append(msg.Answer, rr)
+			msg.Extra = append(msg.Extra, glue)
+		default:
+			soa, _ := dns.NewRR("test. 300 IN SOA ns.test. admin.test. 1 7200 3600 1209600 60")
+			msg.Ns = append(msg.Ns, soa)
+		}
+		w.WriteMsg(msg)
+	}
+	_, serverAddr := startMockDNSServer(t, handler)
+
+	proxy, err := NewDNSProxy(Config{
+		Default: ForwarderConfig{Upstreams: upstreamAddrs(serverAddr)},
+		Zones: Zones{
+			{Name: "public", ZoneConfig: ZoneConfig{Domains: []string{"public.test"}, ReturnPublicIPv4: true}},
+			{Name: "default", ZoneConfig: ZoneConfig{Domains: []string{"."}, Prefix: NAT64Prefixes{{netip.MustParsePrefix("300:dada:feda:f123:ff::/96")}}}},
+		},
+		Cache: CacheConfig{MaxTTL: time.Hour},
+	}, New(time.Minute, 0))
+	if err != nil {
+		t.Fatalf("NewDNSProxy() error = %v", err)
+	}
+	defer proxy.Close()
+	cacheStats.Add("hits", 0)
+	hits := cacheStats.Get("hits").(*expvar.Int).Value()
+
+	query := new(dns.Msg)
+	query.SetQuestion("host.test.", dns.TypeAAAA)
+	resp, err := proxy.getResponse(query, nil)
+	if err != nil || len(resp.Answer) != 1 {
+		t.Fatalf("getResponse() = %v, %v", resp, err)
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 120 {
+		t.Errorf("Synthesized record TTL = %d, want A record TTL 120", ttl)
+	}
+	sent := queries.Load()
+
+	// Cached A answer is rewritten by the zone again
+	query.SetQuestion("HOST.test.", dns.TypeAAAA)
+	resp, err = proxy.getResponse(query, nil)
+	if err != nil || len(resp.Answer) != 1 {
+		t.Fatalf("getResponse() = %v, %v", resp, err)
+	}
+	if rr := resp.Answer[0].Header(); rr.Ttl == 0 || rr.Ttl > 120 || rr.Name != "HOST.test." || rr.Rrtype != dns.TypeAAAA {
+		t.Errorf("Cached record = %s, want AAAA with TTL up to 120 and the asked name", resp.Answer[0])
+	}
+	query.SetQuestion("host.test.", dns.TypeA)
+	if resp, err = proxy.getResponse(query, nil); err != nil || len(resp.Answer) != 0 {
+		t.Errorf("getResponse() of A = %v, %v, want no public IPv4", resp, err)
+	}
+	if queries.Load() != sent {
+		t.Errorf("Cached answers are queried again")
+	}
+
+	// Other types are cached with all sections
+	query.SetQuestion("public.test.", dns.TypeMX)
+	for i := 0; i < 2; i++ {
+		resp, err = proxy.getResponse(query, nil)
+		if err != nil || len(resp.Answer) != 1 || len(resp.Extra) != 1 {
+			t.Fatalf("getResponse() of MX = %v, %v", resp, err)
+		}
+	}
+	if queries.Load() != sent+1 {
+		t.Errorf("MX is queried %d times, want once", queries.Load()-sent)
+	}
+	if got := cacheStats.Get("hits").(*expvar.Int).Value() - hits; got != 4 {
+		t.Errorf("Cache hits = %d, want 4", got)
+	}
+
+	// TTL goes down with the time left
+	key := proxy.cacheKey(&query.Question[0])
+	cached, _ := proxy.Cache.Get(key)
+	soon := cached.(cachedResponse)
+	soon.Expires = time.Now().Add(10 * time.Second)
+	proxy.Cache.Set(key, soon, 10*time.Second)
+	resp, err = proxy.exchange(proxy.defaultForward, query)
+	if err != nil || resp.Answer[0].Header().Ttl > 10 || resp.Extra[0].Header().Ttl > 10 {
+		t.Errorf("exchange() = %v, %v, want TTL up to 10", resp, err)
+	}
+	if cached.(cachedResponse).Answer[0].Header().Ttl != 300 {
+		t.Errorf("Serving changes cached records: %v", cached)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	var queries atomic.Int32
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		soa, _ := dns.NewRR("test. 300 IN SOA ns.test. admin.test. 1 7200 3600 1209600 60")
+		switch r.Question[0].Name {
+		case "nx.test.":
+			msg.Rcode = dns.RcodeNameError
+			msg.Ns = append(msg.Ns, soa)
+		case "nodata.test.":
+			msg.Ns = append(msg.Ns, soa)
+		case "nosoa.test.":
+			msg.Rcode = dns.RcodeNameError
+		case "alias.test.":
+			cname, _ := dns.NewRR("alias.test. 600 IN CNAME nx.test.")
+			msg.Rcode = dns.RcodeNameError
+			msg.Answer = append(msg.Answer, cname)
+			msg.Ns = append(msg.Ns, soa)
+		}
+		w.WriteMsg(msg)
+	}
+	_, serverAddr := startMockDNSServer(t, handler)
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		cache   CacheConfig
+		rcode   int
+		cached  bool
+		maxTTL  uint32
+		answers int
+	}{
+		{"NXDOMAIN", "nx.test.", dns.TypeMX, CacheConfig{}, dns.RcodeNameError, true, 60, 0},
+		{"NXDOMAIN of AAAA", "nx.test.", dns.TypeAAAA, CacheConfig{}, dns.RcodeNameError, true, 60, 0},
+		{"NODATA without A either", "nodata.test.", dns.TypeAAAA, CacheConfig{}, dns.RcodeSuccess, true, 60, 0},
+		{"NODATA of TXT", "nodata.test.", dns.TypeTXT, CacheConfig{}, dns.RcodeSuccess, true, 60, 0},
+		{"Capped TTL", "nx.test.", dns.TypeTXT, CacheConfig{NegativeMaxTTL: 30 * time.Second}, dns.RcodeNameError, true, 30, 0},
+		{"No SOA", "nosoa.test.", dns.TypeTXT, CacheConfig{}, dns.RcodeNameError, false, 0, 0},
+		{"Bypass", "nx.test.", dns.TypeTXT, CacheConfig{Bypass: true}, dns.RcodeNameError, false, 0, 0},
+		{"NXDOMAIN through CNAME", "alias.test.", dns.TypeTXT, CacheConfig{}, dns.RcodeNameError, true, 60, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := NewDNSProxy(Config{
+				Default: ForwarderConfig{Upstreams: upstreamAddrs(serverAddr)},
+				Zones:   Zones{{Name: "default", ZoneConfig: ZoneConfig{Domains: []string{"."}, Prefix: NAT64Prefixes{{netip.MustParsePrefix("300:dada:feda:f123:ff::/96")}}}}},
+				Cache:   tt.cache,
+			}, New(time.Minute, 0))
+			if err != nil {
+				t.Fatalf("NewDNSProxy() error = %v", err)
+			}
+			defer proxy.Close()
+
+			query := new(dns.Msg)
+			query.SetQuestion(tt.qname, tt.qtype)
+			if _, err := proxy.getResponse(query, nil); err != nil {
+				t.Fatalf("getResponse() error = %v", err)
+			}
+			sent := queries.Load()
+			resp, err := proxy.getResponse(query, nil)
+			if err != nil {
+				t.Fatalf("getResponse() error = %v", err)
+			}
+			if resp.Rcode != tt.rcode || len(resp.Answer) != tt.answers {
+				t.Errorf("getResponse() = %s %v, want %s with %d answer records", dns.RcodeToString[resp.Rcode], resp.Answer, dns.RcodeToString[tt.rcode], tt.answers)
+			}
+			if cached := queries.Load() == sent; cached != tt.cached {
+				t.Errorf("Answer is cached = %v, want %v", cached, tt.cached)
+			}
+			if tt.cached {
+				if len(resp.Ns) != 1 || resp.Ns[0].Header().Ttl == 0 || resp.Ns[0].Header().Ttl > tt.maxTTL {
+					t.Errorf("Cached authority = %v, want SOA with TTL up to %d", resp.Ns, tt.maxTTL)
+				}
+			}
+		})
+	}
+}
+
+// Make cached response expire in d, as if the rest of its TTL has passed
+func expireCached(t *testing.T, proxy *DNSProxy, key string, d time.Duration) {
+	t.Helper()
+	cached, found := proxy.cachedResponse(key)
+	if !found {
+		t.Fatalf("%s is not cached", key)
+	}
+	cached.Expires = time.Now().Add(d)
+	if d+proxy.staleTTL <= 0 {
+		proxy.Cache.Delete(key)
+		return
+	}
+	proxy.Cache.Set(key, cached, d+proxy.staleTTL)
+}
+
+func TestServeStale(t *testing.T) {
+	var failing, slow atomic.Bool
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		if slow.Load() {
+			time.Sleep(300 * time.Millisecond)
+		}
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		switch {
+		case failing.Load():
+			msg.Rcode = dns.RcodeServerFailure
+		case r.Question[0].Qtype == dns.TypeA:
+			rr, _ := dns.NewRR("host.test. 120 IN A 10.0.0.1")
+			msg.Answer = append(msg.Answer, rr)
+		default:
+			soa, _ := dns.NewRR("test. 300 IN SOA ns.test. admin.test. 1 7200 3600 1209600 60")
+			msg.Ns = append(msg.Ns, soa)
+		}
+		w.WriteMsg(msg)
+	}
+	_, serverAddr := startMockDNSServer(t, handler)
+
+	tests := []struct {
+		name    string
+		cache   CacheConfig
+		failing bool
+		slow    bool
+		rcode   int
+		ttl     uint32
+	}{
+		{"Stale answer", CacheConfig{StaleTTL: time.Hour}, true, false, dns.RcodeSuccess, 30},
+		{"Stale answer TTL", CacheConfig{StaleTTL: time.Hour, StaleAnswerTTL: 5 * time.Second}, true, false, dns.RcodeSuccess, 5},
+		{"Upstream works", CacheConfig{StaleTTL: time.Hour}, false, false, dns.RcodeSuccess, 120},
+		{"Slow upstream", CacheConfig{StaleTTL: time.Hour}, false, true, dns.RcodeSuccess, 30},
+		{"No stale-ttl", CacheConfig{}, true, false, dns.RcodeServerFailure, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failing.Store(false)
+			slow.Store(false)
+			proxy, err := NewDNSProxy(Config{
+				Default: ForwarderConfig{Upstreams: upstreamAddrs(serverAddr)},
+				Zones:   Zones{{Name: "default", ZoneConfig: ZoneConfig{Domains: []string{"."}, Prefix: NAT64Prefixes{{netip.MustParsePrefix("300:dada:feda:f123:ff::/96")}}}}},
+				Cache:   tt.cache,
+			}, New(time.Minute, 0))
+			if err != nil {
+				t.Fatalf("NewDNSProxy() error = %v", err)
+			}
+			defer proxy.Close()
+			proxy.staleAnswerTimeout = 50 * time.Millisecond
+
+			query := new(dns.Msg)
+			query.SetQuestion("host.test.", dns.TypeAAAA)
+			if _, err := proxy.getResponse(query, nil); err != nil {
+				t.Fatalf("getResponse() error = %v", err)
+			}
+			aKey := proxy.cacheKey(&dns.Question{Name: "host.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+			for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				expireCached(t, proxy, proxy.cacheKey(&dns.Question{Name: "host.test.", Qtype: qtype, Qclass: dns.ClassINET}), -time.Second)
+			}
+
+			failing.Store(tt.failing)
+			slow.Store(tt.slow)
+			resp, err := proxy.getResponse(query, nil)
+			if err != nil {
+				t.Fatalf("getResponse() error = %v", err)
+			}
+			if resp.Rcode != tt.rcode {
+				t.Fatalf("getResponse() = %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if tt.rcode == dns.RcodeSuccess {
+				if len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != tt.ttl {
+					t.Errorf("getResponse() answer = %v, want AAAA with TTL %d", resp.Answer, tt.ttl)
+				}
+			}
+			if !tt.slow {
+				return
+			}
+			// Upstream query goes on after the stale answer and refreshes the cache
+			deadline := time.Now().Add(2 * time.Second)
+			for time.Now().Before(deadline) {
+				if cached, _ := proxy.cachedResponse(aKey); time.Until(cached.Expires) > 0 {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			t.Errorf("Stale response is not refreshed by the slow upstream")
+		})
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	var queries atomic.Int32
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 100 IN TXT \"hot\"")
+		msg.Answer = append(msg.Answer, rr)
+		w.WriteMsg(msg)
+	}
+	_, serverAddr := startMockDNSServer(t, handler)
+
+	proxy, err := NewDNSProxy(Config{
+		Default: ForwarderConfig{Upstreams: upstreamAddrs(serverAddr)},
+		Zones:   Zones{{Name: "default", ZoneConfig: ZoneConfig{Domains: []string{"."}, Prefix: NAT64Prefixes{{netip.MustParsePrefix("300:dada:feda:f123:ff::/96")}}}}},
+		Cache:   CacheConfig{Prefetch: 3},
+	}, New(time.Minute, 0))
+	if err != nil {
+		t.Fatalf("NewDNSProxy() error = %v", err)
+	}
+	defer proxy.Close()
+
+	query := func(name string, times int) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeTXT)
+		for i := 0; i < times; i++ {
+			if _, err := proxy.getResponse(m, nil); err != nil {
+				t.Fatalf("getResponse() error = %v", err)
+			}
+		}
+	}
+	hotKey := proxy.cacheKey(&dns.Question{Name: "hot.test.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+	coldKey := proxy.cacheKey(&dns.Question{Name: "cold.test.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+	query("hot.test.", 1)
+	query("cold.test.", 1)
+	// Less than a tenth of TTL is left
+	expireCached(t, proxy, hotKey, 5*time.Second)
+	expireCached(t, proxy, coldKey, 5*time.Second)
+	sent := queries.Load()
+
+	query("cold.test.", 2)
+	query("hot.test.", 5)
+	deadline := time.Now().Add(2 * time.Second)
+	for queries.Load() == sent && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := queries.Load() - sent; got != 1 {
+		t.Fatalf("Prefetch queries = %d, want 1", got)
+	}
+	// Refreshed response is cached before the next hit could miss
+	for time.Now().Before(deadline) {
+		if hot, _ := proxy.cachedResponse(hotKey); time.Until(hot.Expires) > time.Minute {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hot, _ := proxy.cachedResponse(hotKey); time.Until(hot.Expires) <= time.Minute {
+		t.Errorf("Hot response expires in %s, want it refreshed", time.Until(hot.Expires))
+	}
+	if cold, _ := proxy.cachedResponse(coldKey); time.Until(cold.Expires) > 5*time.Second {
+		t.Errorf("Cold response is refreshed")
+	}
+
+	// Responses loaded from the cache file have no hits counted yet
+	var file bytes.Buffer
+	if err := proxy.Cache.Save(&file); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	proxy.Cache.Flush()
+	if err := proxy.Cache.Load(&file); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	sent = queries.Load()
+	query("cold.test.", 3)
+	deadline = time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cold, _ := proxy.cachedResponse(coldKey); time.Until(cold.Expires) > time.Minute {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := queries.Load() - sent; got != 1 {
+		t.Errorf("Prefetch queries of loaded response = %d, want 1", got)
+	}
+}
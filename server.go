@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Handle queries with the current proxy. Proxy may be replaced while serving,
+// queries in flight are finished by the proxy they started with.
+func newHandler(current *atomic.Pointer[DNSProxy], logger *Log) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		switch r.Opcode {
+		case dns.OpcodeQuery:
+			proxy := acquireProxy(current)
+			defer proxy.active.RUnlock()
+			m, err := proxy.getResponse(r, addrIP(w.RemoteAddr()))
+			if err != nil {
+				logger.Errorf("Failed lookup for %s with error: %s\n", r, err.Error())
+			}
+			truncateResponse(r, m, w.LocalAddr().Network())
+			w.WriteMsg(m)
+		default:
+			// Every query gets an answer, so clients don't wait for it until timeout
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeNotImplemented)
+			w.WriteMsg(m)
+		}
+	})
+}
+
+// Current proxy, held for reading until the query is finished. Proxy replaced
+// before it is held is skipped, so queries never run on a closed proxy, and
+// queries don't wait for a replaced proxy to drain.
+func acquireProxy(current *atomic.Pointer[DNSProxy]) *DNSProxy {
+	for {
+		proxy := current.Load()
+		if !proxy.active.TryRLock() {
+			if current.Load() != proxy {
+				// Replaced proxy is waiting for its queries to be closed
+				continue
+			}
+			proxy.active.RLock()
+		}
+		if current.Load() == proxy {
+			return proxy
+		}
+		proxy.active.RUnlock()
+	}
+}
+
+// Refuse queries from clients outside of allowed networks
+func aclHandler(allow []*net.IPNet, next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		ip := addrIP(w.RemoteAddr())
+		for _, network := range allow {
+			if ip != nil && network.Contains(ip) {
+				next.ServeDNS(w, r)
+				return
+			}
+		}
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+	})
+}
+
+// Parse allowed networks. Single addresses are accepted as well
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// Certificate and key files of a TLS listener. They are read again on Reload
+type certStore struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+func newCertStore(certFile, keyFile string) (*certStore, error) {
+	store := &certStore{certFile: certFile, keyFile: keyFile}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Load certificate files. On error the current certificate is kept
+func (c *certStore) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+func (c *certStore) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return c.cert.Load(), nil
+		},
+	}
+}
+
+// Listener with the server serving it
+type server struct {
+	cfg  ListenerConfig
+	dns  *dns.Server
+	http *http.Server
+	ln   net.Listener
+	pc   net.PacketConn
+	cert *certStore
+}
+
+// Group of servers sharing one handler. Servers are started and stopped together.
+type serverGroup struct {
+	servers     []*server
+	errc        chan error
+	once        sync.Once
+	shutdownErr error
+}
+
+// Bind all listeners and start serving on them.
+// If any listener fails to bind, the already bound ones are closed.
+func startServers(listeners Listeners, handler dns.Handler) (*serverGroup, error) {
+	g := &serverGroup{}
+	for _, l := range listeners {
+		s, err := bindServer(l, handler)
+		if err != nil {
+			for _, s := range g.servers {
+				s.close()
+			}
+			return nil, fmt.Errorf("listener %s: %w", l, err)
+		}
+		g.servers = append(g.servers, s)
+	}
+	g.errc = make(chan error, len(g.servers))
+
+	var started sync.WaitGroup
+	for _, s := range g.servers {
+		var once sync.Once
+		done := func() { once.Do(started.Done) }
+		started.Add(1)
+		go func(s *server) {
+			err := s.serve(done)
+			done()
+			g.errc <- err
+		}(s)
+	}
+	started.Wait()
+	return g, nil
+}
+
+// Bind listener socket and build a server for it
+func bindServer(l ListenerConfig, handler dns.Handler) (s *server, err error) {
+	s = &server{cfg: l}
+	if len(l.Allow) > 0 {
+		allow, err := parseNetworks(l.Allow)
+		if err != nil {
+			return nil, err
+		}
+		handler = aclHandler(allow, handler)
+	}
+	if l.Protocol == "dot" || l.Protocol == "doh" {
+		s.cert, err = newCertStore(l.Cert, l.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch l.Protocol {
+	case "udp":
+		s.pc, err = net.ListenPacket("udp", l.Address)
+		if err != nil {
+			return nil, err
+		}
+		s.dns = &dns.Server{PacketConn: s.pc, Net: "udp", Handler: handler}
+	case "tcp":
+		s.ln, err = net.Listen("tcp", l.Address)
+		if err != nil {
+			return nil, err
+		}
+		s.dns = &dns.Server{Listener: s.ln, Net: "tcp", Handler: handler}
+	case "dot":
+		s.ln, err = net.Listen("tcp", l.Address)
+		if err != nil {
+			return nil, err
+		}
+		s.dns = &dns.Server{Listener: tls.NewListener(s.ln, s.cert.tlsConfig()), Net: "tcp-tls", Handler: handler}
+	case "doh":
+		s.ln, err = net.Listen("tcp", l.Address)
+		if err != nil {
+			return nil, err
+		}
+		path := l.Path
+		if path == "" {
+			path = "/dns-query"
+		}
+		mux := http.NewServeMux()
+		mux.Handle(path, dohHandler(handler))
+		s.http = &http.Server{
+			Handler:           mux,
+			TLSConfig:         s.cert.tlsConfig(),
+			ReadHeaderTimeout: dohHeaderTimeout,
+			IdleTimeout:       dohIdleTimeout,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", l.Protocol)
+	}
+	return s, nil
+}
+
+// Serve until shutdown. started is called once the server accepts queries
+func (s *server) serve(started func()) error {
+	if s.http != nil {
+		started()
+		err := s.http.ServeTLS(s.ln, "", "")
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	}
+	s.dns.NotifyStartedFunc = started
+	return s.dns.ActivateAndServe()
+}
+
+// Stop accepting queries and wait for the ones in flight until ctx is done
+func (s *server) shutdown(ctx context.Context) error {
+	if s.http != nil {
+		return s.http.Shutdown(ctx)
+	}
+	return s.dns.ShutdownContext(ctx)
+}
+
+// Release socket of a server that was never started
+func (s *server) close() {
+	if s.pc != nil {
+		s.pc.Close()
+	}
+	if s.ln != nil {
+		s.ln.Close()
+	}
+}
+
+func (s *server) Addr() net.Addr {
+	if s.pc != nil {
+		return s.pc.LocalAddr()
+	}
+	return s.ln.Addr()
+}
+
+// Addresses the servers are listening on, in "network address" form.
+func (g *serverGroup) Addrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(g.servers))
+	for _, s := range g.servers {
+		addrs = append(addrs, s.Addr())
+	}
+	return addrs
+}
+
+// Load certificates of TLS listeners again. Listeners failed to load keep the old ones
+func (g *serverGroup) ReloadCertificates() error {
+	var errs []error
+	for _, s := range g.servers {
+		if s.cert == nil {
+			continue
+		}
+		if err := s.cert.Reload(); err != nil {
+			errs = append(errs, fmt.Errorf("listener %s: %w", s.cfg, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Block until one of the servers stops, then shut down the rest.
+func (g *serverGroup) Wait() error {
+	err := <-g.errc
+	g.Shutdown()
+	return err
+}
+
+// Stop all servers
+func (g *serverGroup) Shutdown() {
+	g.ShutdownContext(context.Background())
+}
+
+// Stop all servers, waiting for queries in flight until ctx is done.
+// Concurrent calls wait for the first one to finish.
+func (g *serverGroup) ShutdownContext(ctx context.Context) error {
+	g.once.Do(func() {
+		errs := make([]error, len(g.servers))
+		var wg sync.WaitGroup
+		for i, s := range g.servers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := s.shutdown(ctx); err != nil {
+					errs[i] = fmt.Errorf("listener %s: %w", s.cfg, err)
+				}
+			}()
+		}
+		wg.Wait()
+		g.shutdownErr = errors.Join(errs...)
+	})
+	return g.shutdownErr
+}
+
+// DoH clients that don't send request headers in time are disconnected,
+// connections idle this long are closed
+const (
+	dohHeaderTimeout = 10 * time.Second
+	dohIdleTimeout   = 2 * time.Minute
+)
+
+// Serve DNS-over-HTTPS requests (RFC 8484) with the dns handler
+func dohHandler(handler dns.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var wire []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dohMediaType {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			wire, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		requestMsg := new(dns.Msg)
+		if err != nil || requestMsg.Unpack(wire) != nil {
+			http.Error(w, "malformed dns message", http.StatusBadRequest)
+			return
+		}
+
+		rw := &dohResponseWriter{local: r.Context().Value(http.LocalAddrContextKey).(net.Addr)}
+		if remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+			rw.remote = remote
+		}
+		// dns.Server checks the same before its handler is called
+		if requestMsg.Response || len(requestMsg.Question) != 1 {
+			m := new(dns.Msg)
+			m.SetRcode(requestMsg, dns.RcodeFormatError)
+			rw.WriteMsg(m)
+		} else {
+			handler.ServeDNS(rw, requestMsg)
+		}
+		if rw.msg == nil {
+			http.Error(w, "no answer to the dns message", http.StatusBadRequest)
+			return
+		}
+		body, err := rw.msg.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(rw.msg)))
+		w.Write(body)
+	})
+}
+
+// ResponseWriter handing the answer back to DoH handler
+type dohResponseWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
+
+// Lowest TTL of the answer records, 0 for empty answers
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	for i, rr := range m.Answer {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
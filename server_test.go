@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestHandler(proxy *DNSProxy) dns.Handler {
+	var current atomic.Pointer[DNSProxy]
+	current.Store(proxy)
+	return newHandler(&current, NewLogger("err"))
+}
+
+func TestServeUDPAndTCP(t *testing.T) {
+	handler := initDnsHandler()
+	// Start the mock upstream DNS server
+	_, upstreamAddr := startMockDNSServer(t, handler)
+
+	proxy, err := NewDNSProxy(Config{
+		Default: ForwarderConfig{Upstreams: upstreamAddrs(upstreamAddr)},
+		Zones: Zones{
+			{Name: "default", ZoneConfig: ZoneConfig{Domains: []string{"."}, ReturnPublicIPv4: true}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewDNSProxy() error = %v", err)
+	}
+	defer proxy.Close()
+
+	listeners := Listeners{
+		{Address: "127.0.0.1:0", Protocol: "udp"},
+		{Address: "127.0.0.1:0", Protocol: "tcp"},
+	}
+	servers, err := startServers(listeners, newTestHandler(proxy))
+	if err != nil {
+		t.Fatalf("startServers() error = %v", err)
+	}
+	defer servers.Shutdown()
+
+	addrs := servers.Addrs()
+	if len(addrs) != len(listeners) {
+		t.Fatalf("startServers() started %d servers, want %d", len(addrs), len(listeners))
+	}
+
+	for _, addr := range addrs {
+		t.Run(addr.Network(), func(t *testing.T) {
+			client := &dns.Client{Net: addr.Network()}
+			query := new(dns.Msg)
+			query.SetQuestion("v4multi.com.", dns.TypeA)
+
+			resp, _, err := client.Exchange(query, addr.String())
+			if err != nil {
+				t.Fatalf("Exchange() over %s error = %v", addr.Network(), err)
+			}
+			if len(resp.Answer) != 2 {
+				t.Errorf("Exchange() over %s answer length = %d, want 2", addr.Network(), len(resp.Answer))
+			}
+			if !resp.RecursionAvailable {
+				t.Errorf("Exchange() over %s response is not marked recursion available", addr.Network())
+			}
+		})
+	}
+}
+
+func TestServersShutdownTogether(t *testing.T) {
+	listeners := Listeners{
+		{Address: "127.0.0.1:0", Protocol: "udp"},
+		{Address: "127.0.0.1:0", Protocol: "tcp"},
+	}
+	servers, err := startServers(listeners, newTestHandler(&DNSProxy{}))
+	if err != nil {
+		t.Fatalf("startServers() error = %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- servers.Wait() }()
+
+	// Stopping one server must stop the whole group
+	servers.servers[1].shutdown(context.Background())
+	if err := <-done; err != nil {
+		t.Errorf("Wait() error = %v", err)
+	}
+	for _, addr := range servers.Addrs() {
+		client := &dns.Client{Net: addr.Network()}
+		query := new(dns.Msg)
+		query.SetQuestion("v4only.com.", dns.TypeA)
+		client.Timeout = 200 * time.Millisecond
+		if _, _, err := client.Exchange(query, addr.String()); err == nil {
+			t.Errorf("%s server still answers after shutdown", addr.Network())
+		}
+	}
+}
+
+func TestServersShutdownDrain(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		answered bool
+	}{
+		{"Queries in flight are finished", 2 * time.Second, true},
+		{"Drain is limited by timeout", 50 * time.Millisecond, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Upstream answers once released, so queries are in flight while servers shut down
+			release := make(chan struct{})
+			var releaseOnce sync.Once
+			releaseUpstream := func() { releaseOnce.Do(func() { close(release) }) }
+			_, upstream := startMockDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+				<-release
+				msg := new(dns.Msg)
+				msg.SetReply(r)
+				rr, _ := dns.NewRR("who.test. 3600 IN A 10.0.0.1")
+				msg.Answer = append(msg.Answer, rr)
+				w.WriteMsg(msg)
+			})
+			proxy, err := NewDNSProxy(Config{
+				Default: ForwarderConfig{Upstreams: upstreamAddrs(upstream)},
+				Zones: Zones{
+					{Name: "default", ZoneConfig: ZoneConfig{Domains: []string{"."}, ReturnPublicIPv4: true}},
+				},
+			}, nil)
+			if err != nil {
+				t.Fatalf("NewDNSProxy() error = %v", err)
+			}
+			t.Cleanup(proxy.Close)
+
+			listeners := Listeners{
+				{Address: "127.0.0.1:0", Protocol: "udp"},
+				{Address: "127.0.0.1:0", Protocol: "tcp"},
+			}
+			servers, err := startServers(listeners, newTestHandler(proxy))
+			if err != nil {
+				t.Fatalf("startServers() error = %v", err)
+			}
+
+			results := make(chan error, len(listeners))
+			pending := len(listeners)
+			for _, addr := range servers.Addrs() {
+				go func(addr net.Addr) {
+					client := &dns.Client{Net: addr.Network(), Timeout: time.Second}
+					query := new(dns.Msg)
+					query.SetQuestion("who.test.", dns.TypeA)
+					_, _, err := client.Exchange(query, addr.String())
+					results <- err
+				}(addr)
+			}
+			// Handlers blocked on the upstream and the clients are finished before the proxy is closed
+			t.Cleanup(func() {
+				releaseUpstream()
+				for ; pending > 0; pending-- {
+					<-results
+				}
+			})
+
+			// Shut down while the queries wait for the upstream
+			time.Sleep(50 * time.Millisecond)
+			if tt.answered {
+				time.AfterFunc(100*time.Millisecond, releaseUpstream)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			err = servers.ShutdownContext(ctx)
+			if tt.answered && err != nil {
+				t.Errorf("ShutdownContext() error = %v", err)
+			}
+			if !tt.answered && err == nil {
+				t.Errorf("ShutdownContext() returned before queries were finished")
+			}
+			if tt.answered {
+				for ; pending > 0; pending-- {
+					if err := <-results; err != nil {
+						t.Errorf("Query in flight failed: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestStartServersBindFailure(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen on TCP: %v", err)
+	}
+	defer busy.Close()
+
+	listeners := Listeners{
+		{Address: "127.0.0.1:0", Protocol: "udp"},
+		{Address: busy.Addr().String(), Protocol: "tcp"},
+	}
+	servers, err := startServers(listeners, newTestHandler(&DNSProxy{}))
+	if err == nil {
+		servers.Shutdown()
+		t.Fatalf("startServers() on busy address succeeded")
+	}
+	if !strings.Contains(err.Error(), listeners[1].String()) {
+		t.Errorf("startServers() error = %q, want it to name %s", err, listeners[1])
+	}
+}
+
+func TestServeTruncated(t *testing.T) {
+	handler := initDnsHandler()
+	// Start the mock upstream DNS server
+	_, upstreamAddr := startMockDNSServer(t, handler)
+
+	proxy, err := NewDNSProxy(Config{
+		Default: ForwarderConfig{Upstreams: upstreamAddrs(upstreamAddr)},
+		Zones: Zones{
+			{Name: "default", ZoneConfig: ZoneConfig{Domains: []string{"."}}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewDNSProxy() error = %v", err)
+	}
+	defer proxy.Close()
+	listeners := Listeners{
+		{Address: "127.0.0.1:0", Protocol: "udp"},
+		{Address: "127.0.0.1:0", Protocol: "tcp"},
+	}
+	servers, err := startServers(listeners, newTestHandler(proxy))
+	if err != nil {
+		t.Fatalf("startServers() error = %v", err)
+	}
+	defer servers.Shutdown()
+	addrs := servers.Addrs()
+
+	tests := []struct {
+		name      string
+		addr      net.Addr
+		udpSize   uint16
+		truncated bool
+	}{
+		{"UDP without EDNS0", addrs[0], 0, true},
+		{"UDP with small EDNS0 buffer", addrs[0], 1232, true},
+		{"UDP with large EDNS0 buffer", addrs[0], 4096, false},
+		{"TCP", addrs[1], 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := new(dns.Msg)
+			query.SetQuestion("bigtxt.com.", dns.TypeTXT)
+			if tt.udpSize != 0 {
+				query.SetEdns0(tt.udpSize, false)
+			}
+			client := &dns.Client{Net: tt.addr.Network()}
+			resp, _, err := client.Exchange(query, tt.addr.String())
+			if err != nil {
+				t.Fatalf("Exchange() error = %v", err)
+			}
+			if resp.Truncated != tt.truncated {
+				t.Errorf("Exchange() truncated = %v, want %v", resp.Truncated, tt.truncated)
+			}
+			if !tt.truncated && len(resp.Answer) != 40 {
+				t.Errorf("Exchange() answer length = %d, want 40", len(resp.Answer))
+			}
+			if (resp.IsEdns0() != nil) != (tt.udpSize != 0) {
+				t.Errorf("Exchange() response EDNS0 presence doesn't match the query")
+			}
+		})
+	}
+}
+
+func TestDoHMalformedQuery(t *testing.T) {
+	handler := dohHandler(dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		t.Errorf("Handler got malformed query %v", r)
+		w.WriteMsg(new(dns.Msg).SetReply(r))
+	}))
+
+	noQuestion := new(dns.Msg)
+	noQuestion.Id = 1
+	response := new(dns.Msg).SetQuestion("host.test.", dns.TypeA)
+	response.Response = true
+	twoQuestions := new(dns.Msg).SetQuestion("host.test.", dns.TypeA)
+	twoQuestions.Question = append(twoQuestions.Question, twoQuestions.Question[0])
+
+	for _, query := range []*dns.Msg{noQuestion, response, twoQuestions} {
+		wire, err := query.Pack()
+		if err != nil {
+			t.Fatalf("Pack() error = %v", err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(wire))
+		r.Header.Set("Content-Type", dohMediaType)
+		r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		resp := new(dns.Msg)
+		if w.Code != http.StatusOK || resp.Unpack(w.Body.Bytes()) != nil {
+			t.Fatalf("DoH status = %d, body %q", w.Code, w.Body.Bytes())
+		}
+		if resp.Id != query.Id || resp.Rcode != dns.RcodeFormatError {
+			t.Errorf("DoH answer to %v = %v, want FORMERR", query, resp)
+		}
+	}
+}
+
+func TestServeEncrypted(t *testing.T) {
+	handler := initDnsHandler()
+	// Start the mock upstream DNS server
+	_, upstreamAddr := startMockDNSServer(t, handler)
+	proxy, err := NewDNSProxy(Config{
+		Default: ForwarderConfig{Upstreams: upstreamAddrs(upstreamAddr)},
+		Zones: Zones{
+			{Name: "default", ZoneConfig: ZoneConfig{Domains: []string{"."}, ReturnPublicIPv4: true}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewDNSProxy() error = %v", err)
+	}
+	defer proxy.Close()
+
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issueFiles(t)
+	listeners := Listeners{
+		{Address: "127.0.0.1:0", Protocol: "dot", Cert: certFile, Key: keyFile},
+		{Address: "127.0.0.1:0", Protocol: "doh", Cert: certFile, Key: keyFile},
+		{Address: "127.0.0.1:0", Protocol: "doh", Cert: certFile, Key: keyFile, Path: "/custom"},
+		{Address: "127.0.0.1:0", Protocol: "dot", Cert: certFile, Key: keyFile, Allow: []string{"10.0.0.0/8", "::1"}},
+		{Address: "127.0.0.1:0", Protocol: "doh", Cert: certFile, Key: keyFile, Allow: []string{"10.0.0.0/8"}},
+		{Address: "127.0.0.1:0", Protocol: "dot", Cert: certFile, Key: keyFile, Allow: []string{"127.0.0.1"}},
+	}
+	servers, err := startServers(listeners, newTestHandler(proxy))
+	if err != nil {
+		t.Fatalf("startServers() error = %v", err)
+	}
+	defer servers.Shutdown()
+	addrs := servers.Addrs()
+
+	// Query listener through our own DoT and DoH upstreams
+	exchange := func(t *testing.T, i int, path string, caFile string, opcode int) (*dns.Msg, error) {
+		address := "tls://" + addrs[i].String()
+		if listeners[i].Protocol == "doh" {
+			address = "https://" + addrs[i].String() + path
+		}
+		upstream, err := newUpstream(UpstreamConfig{Address: address, CAFile: caFile}, time.Second)
+		if err != nil {
+			t.Fatalf("newUpstream() error = %v", err)
+		}
+		defer upstream.Close()
+		query := new(dns.Msg)
+		query.SetQuestion("v4multi.com.", dns.TypeA)
+		query.Opcode = opcode
+		return upstream.Exchange(context.Background(), query)
+	}
+
+	caFile := ca.writeFile(t)
+	tests := []struct {
+		name     string
+		listener int
+		path     string
+		opcode   int
+		rcode    int
+	}{
+		{"DoT", 0, "", dns.OpcodeQuery, dns.RcodeSuccess},
+		{"DoH", 1, "/dns-query", dns.OpcodeQuery, dns.RcodeSuccess},
+		{"DoH custom path", 2, "/custom", dns.OpcodeQuery, dns.RcodeSuccess},
+		{"DoT refused by ACL", 3, "", dns.OpcodeQuery, dns.RcodeRefused},
+		{"DoH refused by ACL", 4, "/dns-query", dns.OpcodeQuery, dns.RcodeRefused},
+		{"DoT allowed by ACL", 5, "", dns.OpcodeQuery, dns.RcodeSuccess},
+		{"DoT NOTIFY", 0, "", dns.OpcodeNotify, dns.RcodeNotImplemented},
+		{"DoH NOTIFY", 1, "/dns-query", dns.OpcodeNotify, dns.RcodeNotImplemented},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := exchange(t, tt.listener, tt.path, caFile, tt.opcode)
+			if err != nil {
+				t.Fatalf("Exchange() error = %v", err)
+			}
+			if resp.Rcode != tt.rcode {
+				t.Errorf("Exchange() rcode = %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if tt.rcode == dns.RcodeSuccess && len(resp.Answer) != 2 {
+				t.Errorf("Exchange() answer length = %d, want 2", len(resp.Answer))
+			}
+		})
+	}
+
+	if _, err := exchange(t, 1, "/other", caFile, dns.OpcodeQuery); err == nil {
+		t.Errorf("DoH query to unknown path succeeded")
+	}
+
+	// Certificates from another CA are picked up on reload
+	newCA := newTestCA(t)
+	newCertFile, newKeyFile := newCA.issueFiles(t)
+	for _, file := range [][2]string{{newCertFile, certFile}, {newKeyFile, keyFile}} {
+		data, _ := os.ReadFile(file[0])
+		os.WriteFile(file[1], data, 0o600)
+	}
+	if err := servers.ReloadCertificates(); err != nil {
+		t.Fatalf("ReloadCertificates() error = %v", err)
+	}
+	newCAFile := newCA.writeFile(t)
+	for _, i := range []int{0, 1} {
+		if _, err := exchange(t, i, "/dns-query", caFile, dns.OpcodeQuery); err == nil {
+			t.Errorf("Listener %s still uses the old certificate", listeners[i])
+		}
+		if _, err := exchange(t, i, "/dns-query", newCAFile, dns.OpcodeQuery); err != nil {
+			t.Errorf("Listener %s doesn't use the new certificate: %v", listeners[i], err)
+		}
+	}
+
+	// Broken files keep the current certificate
+	os.WriteFile(certFile, []byte("garbage"), 0o600)
+	if err := servers.ReloadCertificates(); err == nil {
+		t.Errorf("ReloadCertificates() with broken files succeeded")
+	}
+	if _, err := exchange(t, 0, "", newCAFile, dns.OpcodeQuery); err != nil {
+		t.Errorf("Listener lost its certificate after failed reload: %v", err)
+	}
+}
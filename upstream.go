@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream DNS server
+type Upstream interface {
+	Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	String() string
+	Close()
+}
+
+// Create upstream by its config address
+func newUpstream(cfg UpstreamConfig, timeout time.Duration) (Upstream, error) {
+	scheme, address, found := strings.Cut(cfg.Address, "://")
+	if !found {
+		scheme, address = "udp", cfg.Address
+	}
+	switch strings.ToLower(scheme) {
+	case "udp":
+		return &plainUpstream{address: address, timeout: timeout}, nil
+	case "tls":
+		return newTLSUpstream(cfg, address, timeout)
+	case "https":
+		return newHTTPSUpstream(cfg, timeout)
+	}
+	return nil, fmt.Errorf("unsupported scheme %q", scheme)
+}
+
+// Plain DNS server, queried over UDP with TCP fallback
+type plainUpstream struct {
+	address string
+	timeout time.Duration
+}
+
+func (u *plainUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if u.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.timeout)
+		defer cancel()
+	}
+	return lookupContext(ctx, u.address, m)
+}
+
+func (u *plainUpstream) String() string {
+	return u.address
+}
+
+func (u *plainUpstream) Close() {}
+
+// TLS client config of upstream server
+func upstreamTLSConfig(cfg UpstreamConfig, host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.CAFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// Address to connect to. If bootstrap IP is set, it replaces the host
+// so the upstream name is not resolved through ourselves.
+func dialAddress(address string, bootstrap string) string {
+	if bootstrap == "" {
+		return address
+	}
+	_, port, _ := net.SplitHostPort(address)
+	return net.JoinHostPort(bootstrap, port)
+}
+
+// DNS-over-TLS server. Queries are pipelined over one persistent connection
+type tlsUpstream struct {
+	address   string
+	dial      string
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	mu   sync.Mutex
+	conn *pipelineConn
+}
+
+func newTLSUpstream(cfg UpstreamConfig, address string, timeout time.Duration) (*tlsUpstream, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		// Port is optional
+		host = strings.Trim(address, "[]")
+		address = net.JoinHostPort(host, "853")
+	}
+	tlsConfig, err := upstreamTLSConfig(cfg, host)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsUpstream{
+		address:   address,
+		dial:      dialAddress(address, cfg.Bootstrap),
+		tlsConfig: tlsConfig,
+		timeout:   timeout,
+	}, nil
+}
+
+func (u *tlsUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if u.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.timeout)
+		defer cancel()
+	}
+	queryMsg := m.Copy()
+	setEDNS0(queryMsg, ednsUDPSize)
+
+	for {
+		conn, reused, err := u.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		response, err := conn.exchange(ctx, queryMsg)
+		if err == nil {
+			return response, nil
+		}
+		// The server could close idle connection just before our query, retry it once on a new one
+		if !reused || ctx.Err() != nil || !errors.Is(err, errConnClosed) {
+			return nil, err
+		}
+	}
+}
+
+// Current connection or a new one if there is none.
+// reused tells if the connection has been used before.
+func (u *tlsUpstream) getConn(ctx context.Context) (conn *pipelineConn, reused bool, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn != nil && !u.conn.isClosed() {
+		return u.conn, true, nil
+	}
+
+	dialer := &tls.Dialer{Config: u.tlsConfig}
+	c, err := dialer.DialContext(ctx, "tcp", u.dial)
+	if err != nil {
+		return nil, false, err
+	}
+	u.conn = newPipelineConn(c)
+	return u.conn, false, nil
+}
+
+func (u *tlsUpstream) String() string {
+	return "tls://" + u.address
+}
+
+func (u *tlsUpstream) Close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn != nil {
+		u.conn.close(errConnClosed)
+		u.conn = nil
+	}
+}
+
+var errConnClosed = errors.New("connection closed")
+
+// Stream connection with queries pipelined by message ID
+type pipelineConn struct {
+	conn    *dns.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	err     error
+	closed  chan struct{}
+}
+
+func newPipelineConn(c net.Conn) *pipelineConn {
+	pc := &pipelineConn{
+		conn:    &dns.Conn{Conn: c},
+		pending: make(map[uint16]chan *dns.Msg),
+		closed:  make(chan struct{}),
+	}
+	go pc.readLoop()
+	return pc
+}
+
+// Send query and wait for the answer with the same ID
+func (pc *pipelineConn) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	reply := make(chan *dns.Msg, 1)
+	pc.mu.Lock()
+	if pc.err != nil {
+		pc.mu.Unlock()
+		return nil, pc.err
+	}
+	// Queries of different clients may have the same ID, give each one its own
+	id := dns.Id()
+	for pc.pending[id] != nil {
+		id = dns.Id()
+	}
+	pc.pending[id] = reply
+	pc.mu.Unlock()
+	defer func() {
+		pc.mu.Lock()
+		delete(pc.pending, id)
+		pc.mu.Unlock()
+	}()
+
+	queryMsg := *m
+	queryMsg.Id = id
+	pc.writeMu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		pc.conn.SetWriteDeadline(deadline)
+	}
+	err := pc.conn.WriteMsg(&queryMsg)
+	pc.writeMu.Unlock()
+	if err != nil {
+		pc.close(errConnClosed)
+		return nil, fmt.Errorf("%w: %s", errConnClosed, err)
+	}
+
+	select {
+	case response := <-reply:
+		response.Id = m.Id
+		return response, nil
+	case <-pc.closed:
+		return nil, pc.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Deliver answers to waiting queries until the connection breaks
+func (pc *pipelineConn) readLoop() {
+	for {
+		response, err := pc.conn.ReadMsg()
+		if err != nil {
+			pc.close(fmt.Errorf("%w: %s", errConnClosed, err))
+			return
+		}
+		pc.mu.Lock()
+		reply := pc.pending[response.Id]
+		pc.mu.Unlock()
+		if reply != nil {
+			select {
+			case reply <- response:
+			default:
+			}
+		}
+	}
+}
+
+func (pc *pipelineConn) close(err error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.err != nil {
+		return
+	}
+	pc.err = err
+	close(pc.closed)
+	pc.conn.Close()
+}
+
+func (pc *pipelineConn) isClosed() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.err != nil
+}
+
+// DNS-over-HTTPS server (RFC 8484). Connections are pooled by HTTP/2 transport
+type httpsUpstream struct {
+	url    *url.URL
+	method string
+	client *http.Client
+}
+
+func newHTTPSUpstream(cfg UpstreamConfig, timeout time.Duration) (*httpsUpstream, error) {
+	u, err := url.Parse(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	method := strings.ToUpper(cfg.Method)
+	switch method {
+	case "":
+		method = http.MethodPost
+	case http.MethodGet, http.MethodPost:
+	default:
+		return nil, fmt.Errorf("method must be one of 'get/post'")
+	}
+	tlsConfig, err := upstreamTLSConfig(cfg, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{}
+	transport := &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, dialAddress(address, cfg.Bootstrap))
+		},
+	}
+	return &httpsUpstream{
+		url:    u,
+		method: method,
+		client: &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
+func (u *httpsUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	queryMsg := m.Copy()
+	setEDNS0(queryMsg, ednsUDPSize)
+	// Zero ID makes answers cacheable by HTTP caches
+	queryMsg.Id = 0
+	wire, err := queryMsg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	if u.method == http.MethodGet {
+		reqURL := *u.url
+		query := reqURL.Query()
+		query.Set("dns", base64.RawURLEncoding.EncodeToString(wire))
+		reqURL.RawQuery = query.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, reqURL.String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, u.url.String(), bytes.NewReader(wire))
+		if req != nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohMediaType)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: HTTP status %s", u.url.Host, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	response := new(dns.Msg)
+	if err := response.Unpack(body); err != nil {
+		return nil, err
+	}
+	response.Id = m.Id
+	return response, nil
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url.String()
+}
+
+func (u *httpsUpstream) Close() {
+	u.client.CloseIdleConnections()
+}
+
+const dohMediaType = "application/dns-message"
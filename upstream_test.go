@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Self-signed certificate authority for test servers
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "yggdns64 test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// Issue server certificate for "dns.test" and 127.0.0.1
+func (ca *testCA) issue(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate server key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		DNSNames:     []string{"dns.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create server certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Issue server certificate and write it with its key to files
+func (ca *testCA) issueFiles(t *testing.T) (certFile, keyFile string) {
+	cert := ca.issue(t)
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("Failed to marshal server key: %v", err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if os.WriteFile(certFile, certPEM, 0o600) != nil || os.WriteFile(keyFile, keyPEM, 0o600) != nil {
+		t.Fatalf("Failed to write certificate files")
+	}
+	return certFile, keyFile
+}
+
+// Write CA certificate to a file
+func (ca *testCA) writeFile(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, ca.pem, 0o600); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+	return path
+}
+
+// Listener counting accepted connections
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+// Mock DNS-over-TLS server setup
+func startMockTLSServer(t *testing.T, handler dns.HandlerFunc, cert tls.Certificate, idleTimeout time.Duration) (string, *countingListener) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen on TCP: %v", err)
+	}
+	counter := &countingListener{Listener: ln}
+	tlsListener := tls.NewListener(counter, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener:          tlsListener,
+		Net:               "tcp-tls",
+		Handler:           handler,
+		NotifyStartedFunc: func() { close(started) },
+		IdleTimeout:       func() time.Duration { return idleTimeout },
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return ln.Addr().String(), counter
+}
+
+func TestTLSUpstream(t *testing.T) {
+	ca := newTestCA(t)
+	addr, _ := startMockTLSServer(t, initDnsHandler(), ca.issue(t), 10*time.Second)
+	caFile := ca.writeFile(t)
+
+	tests := []struct {
+		name    string
+		cfg     UpstreamConfig
+		success bool
+	}{
+		{"Verified by CA file", UpstreamConfig{Address: "tls://" + addr, CAFile: caFile}, true},
+		{"Verified with SNI", UpstreamConfig{Address: "tls://" + addr, CAFile: caFile, ServerName: "dns.test"}, true},
+		{"Wrong server name", UpstreamConfig{Address: "tls://" + addr, CAFile: caFile, ServerName: "other.test"}, false},
+		{"Unknown CA", UpstreamConfig{Address: "tls://" + addr}, false},
+		{"Verification disabled", UpstreamConfig{Address: "tls://" + addr, InsecureSkipVerify: true}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream, err := newUpstream(tt.cfg, time.Second)
+			if err != nil {
+				t.Fatalf("newUpstream() error = %v", err)
+			}
+			defer upstream.Close()
+
+			query := new(dns.Msg)
+			query.SetQuestion("v4multi.com.", dns.TypeA)
+			resp, err := upstream.Exchange(context.Background(), query)
+			if !tt.success {
+				if err == nil {
+					t.Errorf("Exchange() succeeded, want verification error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Exchange() error = %v", err)
+			}
+			if resp.Id != query.Id || len(resp.Answer) != 2 {
+				t.Errorf("Exchange() response = %v", resp)
+			}
+		})
+	}
+
+	if _, err := newUpstream(UpstreamConfig{Address: "tls://" + addr, CAFile: filepath.Join(t.TempDir(), "none.pem")}, time.Second); err == nil {
+		t.Errorf("newUpstream() with missing CA file succeeded")
+	}
+	if _, err := newUpstream(UpstreamConfig{Address: "quic://" + addr}, time.Second); err == nil {
+		t.Errorf("newUpstream() with unknown scheme succeeded")
+	}
+}
+
+func TestTLSUpstreamPipelining(t *testing.T) {
+	ca := newTestCA(t)
+	addr, listener := startMockTLSServer(t, initDnsHandler(), ca.issue(t), 200*time.Millisecond)
+	upstream, err := newUpstream(UpstreamConfig{Address: "tls://" + addr, CAFile: ca.writeFile(t)}, time.Second)
+	if err != nil {
+		t.Fatalf("newUpstream() error = %v", err)
+	}
+	defer upstream.Close()
+
+	// Queries with the same ID from different clients share one connection
+	names := []string{"v4only.com.", "longv4only.com.", "v4multi.com.", "v6only.com."}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			query := new(dns.Msg)
+			query.SetQuestion(name, dns.TypeA)
+			query.Id = 42
+			resp, err := upstream.Exchange(context.Background(), query)
+			if err != nil {
+				t.Errorf("Exchange() error = %v", err)
+				return
+			}
+			if resp.Id != 42 || resp.Question[0].Name != name {
+				t.Errorf("Exchange() got response %d for %s, want 42 for %s", resp.Id, resp.Question[0].Name, name)
+			}
+		}(names[i%len(names)])
+	}
+	wg.Wait()
+	if n := listener.accepted.Load(); n != 1 {
+		t.Errorf("Server accepted %d connections, want 1", n)
+	}
+
+	// Connection closed by the server is replaced
+	time.Sleep(400 * time.Millisecond)
+	query := new(dns.Msg)
+	query.SetQuestion("v4only.com.", dns.TypeA)
+	if _, err := upstream.Exchange(context.Background(), query); err != nil {
+		t.Fatalf("Exchange() after idle timeout error = %v", err)
+	}
+	if n := listener.accepted.Load(); n != 2 {
+		t.Errorf("Server accepted %d connections, want 2", n)
+	}
+}
+
+// Minimal ResponseWriter capturing the reply of a dns handler
+type captureWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *captureWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *captureWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// Mock DNS-over-HTTPS server serving handler at /dns-query
+func startMockHTTPSServer(t *testing.T, handler dns.HandlerFunc, cert tls.Certificate) (*httptest.Server, *sync.Map, *atomic.Int32) {
+	var methods sync.Map
+	var conns atomic.Int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns-query" || r.ProtoMajor != 2 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var wire []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dohMediaType {
+				http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			wire, err = io.ReadAll(r.Body)
+		}
+		query := new(dns.Msg)
+		if err != nil || query.Unpack(wire) != nil {
+			http.Error(w, "bad message", http.StatusBadRequest)
+			return
+		}
+		methods.Store(r.Method, true)
+
+		cw := &captureWriter{}
+		handler(cw, query)
+		reply, _ := cw.msg.Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(reply)
+	}))
+	ts.EnableHTTP2 = true
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts, &methods, &conns
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	ca := newTestCA(t)
+	ts, methods, conns := startMockHTTPSServer(t, initDnsHandler(), ca.issue(t))
+	caFile := ca.writeFile(t)
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	tests := []struct {
+		name    string
+		cfg     UpstreamConfig
+		method  string
+		success bool
+	}{
+		{"POST by default", UpstreamConfig{Address: ts.URL + "/dns-query", CAFile: caFile}, http.MethodPost, true},
+		{"GET", UpstreamConfig{Address: ts.URL + "/dns-query", CAFile: caFile, Method: "get"}, http.MethodGet, true},
+		{"Bootstrap address", UpstreamConfig{Address: "https://dns.test:" + port + "/dns-query", CAFile: caFile, Bootstrap: "127.0.0.1"}, http.MethodPost, true},
+		{"Unknown CA", UpstreamConfig{Address: ts.URL + "/dns-query"}, "", false},
+		{"Wrong path", UpstreamConfig{Address: ts.URL + "/resolve", CAFile: caFile}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			methods.Range(func(key, _ any) bool {
+				methods.Delete(key)
+				return true
+			})
+			conns.Store(0)
+			upstream, err := newUpstream(tt.cfg, time.Second)
+			if err != nil {
+				t.Fatalf("newUpstream() error = %v", err)
+			}
+			defer upstream.Close()
+
+			// Several queries reuse one connection
+			for i := 0; i < 5; i++ {
+				query := new(dns.Msg)
+				query.SetQuestion("v4multi.com.", dns.TypeA)
+				resp, err := upstream.Exchange(context.Background(), query)
+				if !tt.success {
+					if err == nil {
+						t.Fatalf("Exchange() succeeded, want error")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Exchange() error = %v", err)
+				}
+				if resp.Id != query.Id || len(resp.Answer) != 2 {
+					t.Fatalf("Exchange() response = %v", resp)
+				}
+			}
+			if _, ok := methods.Load(tt.method); !ok {
+				t.Errorf("Server didn't get %s requests", tt.method)
+			}
+			if n := conns.Load(); n != 1 {
+				t.Errorf("Server accepted %d connections, want 1", n)
+			}
+		})
+	}
+
+	if _, err := newUpstream(UpstreamConfig{Address: ts.URL + "/dns-query", Method: "put"}, time.Second); err == nil {
+		t.Errorf("newUpstream() with unknown method succeeded")
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Check config values YAML decoding can't check. All problems are returned
+// at once, each one prefixed with its path in the config file.
+func (c *Config) Validate() error {
+	var errs []error
+	addErr := func(path string, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+
+	if len(c.Listen) == 0 {
+		addErr("listen", "no listen addresses")
+	}
+	badAddress := make(map[string]bool)
+	for i, l := range c.Listen {
+		path := fmt.Sprintf("listen[%d]", i)
+		// Address without protocol is listened twice, report it once
+		if err := checkHostPort(l.Address); err != nil && !badAddress[l.Address] {
+			badAddress[l.Address] = true
+			addErr(path, "%s", err)
+		}
+		switch l.Protocol {
+		case "udp", "tcp":
+		case "dot", "doh":
+			if l.Cert == "" || l.Key == "" {
+				addErr(path, "%s listener needs cert and key", l.Protocol)
+			}
+		default:
+			addErr(path+".protocol", "%q must be one of 'udp/tcp/dot/doh'", l.Protocol)
+		}
+		if _, err := parseNetworks(l.Allow); err != nil {
+			addErr(path+".allow", "%s", err)
+		}
+	}
+
+	checkZones(c.Zones, "zones", addErr)
+	if !hasCatchAll(c.Zones) {
+		addErr("zones", `no zone has "." domain for names outside of other zones`)
+	}
+	if len(c.Default.Upstreams) > 0 {
+		checkForwarder(c.Default, "default", addErr)
+	}
+	checkForwarders(c.Forwarders, "forwarders", addErr)
+	checkStatic(c.Static, "static", addErr)
+
+	for _, view := range c.Views {
+		path := keyPath("views", view.Name)
+		if len(view.Clients) == 0 {
+			addErr(path+".clients", "no client networks")
+		}
+		if _, err := parseNetworks(view.Clients); err != nil {
+			addErr(path+".clients", "%s", err)
+		}
+		checkZones(view.Zones, path+".zones", addErr)
+		if view.Zones != nil && !hasCatchAll(view.Zones) {
+			addErr(path+".zones", `no zone has "." domain for names outside of other zones`)
+		}
+		if len(view.Default.Upstreams) > 0 {
+			checkForwarder(view.Default, path+".default", addErr)
+		}
+		checkForwarders(view.Forwarders, path+".forwarders", addErr)
+		checkStatic(view.Static, path+".static", addErr)
+	}
+
+	if c.UDPSize < dns.MinMsgSize {
+		addErr("edns-buffer-size", "%d is less than %d", c.UDPSize, dns.MinMsgSize)
+	}
+	if c.Cache.ExpTime < 0 {
+		addErr("cache.expiration", "negative value %d", c.Cache.ExpTime)
+	}
+	if c.Cache.PurgeTime < 0 {
+		addErr("cache.purge", "negative value %d", c.Cache.PurgeTime)
+	}
+	if c.Cache.MaxItems < 0 {
+		addErr("cache.max-items", "negative value %d", c.Cache.MaxItems)
+	}
+	if c.Cache.MaxBytes < 0 {
+		addErr("cache.max-bytes", "negative value %d", c.Cache.MaxBytes)
+	}
+	if c.Cache.MinTTL < 0 {
+		addErr("cache.min-ttl", "negative value %s", c.Cache.MinTTL)
+	}
+	if c.Cache.MaxTTL < 0 {
+		addErr("cache.max-ttl", "negative value %s", c.Cache.MaxTTL)
+	}
+	if c.Cache.NegativeMaxTTL < 0 {
+		addErr("cache.negative-max-ttl", "negative value %s", c.Cache.NegativeMaxTTL)
+	}
+	if c.Cache.StaleTTL < 0 {
+		addErr("cache.stale-ttl", "negative value %s", c.Cache.StaleTTL)
+	}
+	if c.Cache.StaleAnswerTTL < 0 {
+		addErr("cache.stale-answer-ttl", "negative value %s", c.Cache.StaleAnswerTTL)
+	}
+	if c.Cache.Prefetch < 0 {
+		addErr("cache.prefetch", "negative value %d", c.Cache.Prefetch)
+	}
+	if maxTTL := c.Cache.maxTTL(); maxTTL > 0 && c.Cache.MinTTL > maxTTL {
+		addErr("cache.min-ttl", "%s is more than the longest cache time %s", c.Cache.MinTTL, maxTTL)
+	}
+	switch c.LogLevel {
+	case "debug", "info", "err", "none":
+	default:
+		addErr("log-level", "%q must be one of 'debug/info/err/none'", c.LogLevel)
+	}
+	if c.Metrics != "" {
+		if err := checkHostPort(c.Metrics); err != nil {
+			addErr("metrics", "%s", err)
+		}
+	}
+	if len(c.listURLs()) > 0 && c.RemoteLists.Dir == "" {
+		addErr("remote-lists.dir", "directory for copies of domains-url lists is not set")
+	}
+	if c.RemoteLists.Refresh < 0 {
+		addErr("remote-lists.refresh", "negative value %s", c.RemoteLists.Refresh)
+	}
+	if c.RemoteLists.Timeout < 0 {
+		addErr("remote-lists.timeout", "negative value %s", c.RemoteLists.Timeout)
+	}
+	if c.WatchInterval < 0 {
+		addErr("watch-interval", "negative value %s", c.WatchInterval)
+	}
+	if c.ShutdownTimeout < 0 {
+		addErr("shutdown-timeout", "negative value %s", c.ShutdownTimeout)
+	}
+	return errors.Join(errs...)
+}
+
+// Config that is valid but most likely not what is meant
+func (c *Config) Warnings() []string {
+	var warnings []string
+	if len(c.Default.Upstreams) == 0 {
+		warnings = append(warnings, "default: no default forwarder, names outside of forwarders fail")
+	}
+	return warnings
+}
+
+func hasCatchAll(zones Zones) bool {
+	for _, zone := range zones {
+		for _, domain := range zone.Domains {
+			if strings.Trim(domain, ".") == "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func checkZones(zones Zones, parent string, addErr func(string, string, ...interface{})) {
+	for _, zone := range zones {
+		path := keyPath(parent, zone.Name)
+		for i, domain := range zone.Domains {
+			if !validDomain(domain) {
+				addErr(fmt.Sprintf("%s.domains[%d]", path, i), "invalid domain name %q", domain)
+			}
+		}
+		for i, fileName := range zone.DomainsFiles {
+			if _, _, err := readDomainsFile(fileName); err != nil {
+				addErr(fmt.Sprintf("%s.domains-file[%d]", path, i), "%s", err)
+			}
+		}
+		for i, listURL := range zone.DomainsURLs {
+			if err := checkListURL(listURL); err != nil {
+				addErr(fmt.Sprintf("%s.domains-url[%d]", path, i), "%s", err)
+			}
+		}
+		for i, prefix := range zone.Prefix {
+			prefixPath := path + ".prefix"
+			if len(zone.Prefix) > 1 {
+				prefixPath = fmt.Sprintf("%s[%d]", prefixPath, i)
+			}
+			if err := checkPrefix(prefix); err != nil {
+				addErr(prefixPath, "%s", err)
+			}
+		}
+	}
+}
+
+func checkForwarders(forwarders map[string]ForwarderConfig, parent string, addErr func(string, string, ...interface{})) {
+	for _, domain := range sortedKeys(forwarders) {
+		path := keyPath(parent, domain)
+		if !validDomain(domain) {
+			addErr(path, "invalid domain name %q", domain)
+		}
+		checkForwarder(forwarders[domain], path, addErr)
+	}
+}
+
+func checkStatic(static map[string]string, parent string, addErr func(string, string, ...interface{})) {
+	for _, domain := range sortedKeys(static) {
+		path := keyPath(parent, domain)
+		if !validDomain(domain) {
+			addErr(path, "invalid domain name %q", domain)
+		}
+		if ip := net.ParseIP(static[domain]); ip == nil || ip.To4() == nil {
+			addErr(path, "%q is not an IPv4 address", static[domain])
+		}
+	}
+}
+
+func checkForwarder(cfg ForwarderConfig, path string, addErr func(string, string, ...interface{})) {
+	if len(cfg.Upstreams) == 0 {
+		addErr(path+".upstreams", "no upstream servers")
+	}
+	for i, u := range cfg.Upstreams {
+		if err := checkUpstream(u); err != nil {
+			addErr(fmt.Sprintf("%s.upstreams[%d]", path, i), "%s", err)
+		}
+	}
+	if cfg.Timeout < 0 {
+		addErr(path+".timeout", "negative value %s", cfg.Timeout)
+	}
+	if cfg.MaxFails < 0 {
+		addErr(path+".max-fails", "negative value %d", cfg.MaxFails)
+	}
+	if cfg.CheckInterval < 0 {
+		addErr(path+".check-interval", "negative value %s", cfg.CheckInterval)
+	}
+	if cfg.Race < 0 {
+		addErr(path+".race", "negative value %d", cfg.Race)
+	}
+}
+
+// Check upstream address the same way newUpstream reads it
+func checkUpstream(u UpstreamConfig) error {
+	if u.Bootstrap != "" && net.ParseIP(u.Bootstrap) == nil {
+		return fmt.Errorf("bootstrap %q is not an IP address", u.Bootstrap)
+	}
+	scheme, address, found := strings.Cut(u.Address, "://")
+	if !found {
+		scheme, address = "udp", u.Address
+	}
+	switch strings.ToLower(scheme) {
+	case "udp":
+		if err := checkHostPort(address); err != nil {
+			return err
+		}
+	case "tls":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			// Port is optional
+			if strings.Trim(address, "[]") == "" {
+				return fmt.Errorf("no host in %q", u.Address)
+			}
+		} else if err := checkHostPort(address); err != nil {
+			return err
+		}
+	case "https":
+		parsed, err := url.Parse(u.Address)
+		if err != nil {
+			return err
+		}
+		if parsed.Hostname() == "" {
+			return fmt.Errorf("no host in %q", u.Address)
+		}
+		switch strings.ToLower(u.Method) {
+		case "", "get", "post":
+		default:
+			return fmt.Errorf("method %q must be one of 'get/post'", u.Method)
+		}
+	default:
+		return fmt.Errorf("unsupported scheme %q", scheme)
+	}
+	return nil
+}
+
+func checkListURL(listURL string) error {
+	parsed, err := url.Parse(listURL)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("%q is not an http or https URL", listURL)
+	}
+	if parsed.Hostname() == "" {
+		return fmt.Errorf("no host in %q", listURL)
+	}
+	return nil
+}
+
+// Address must have a host and a port
+func checkHostPort(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("invalid port in %q", address)
+	}
+	return nil
+}
+
+// Prefix must have one of RFC 6052 lengths and zero bits after it
+func checkPrefix(prefix NAT64Prefix) error {
+	if !prefix.IsValid() {
+		return errors.New("not an IPv6 prefix")
+	}
+	if prefix.Addr().IsUnspecified() {
+		return fmt.Errorf("unspecified prefix %s", prefix.Addr())
+	}
+	switch prefix.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return fmt.Errorf("length of %s must be one of 32, 40, 48, 56, 64 or 96", prefix)
+	}
+	if prefix.Masked() != prefix.Prefix {
+		return fmt.Errorf("%s has bits set after the prefix length", prefix)
+	}
+	return nil
+}
+
+// Domain name with optional leading and trailing dots, "." matches everything
+func validDomain(domain string) bool {
+	name := strings.Trim(domain, ".")
+	if name == "" {
+		return domain != ""
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return false
+	}
+	// Address looks like a name made of digits, but never matches one
+	if net.ParseIP(name) != nil {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return !strings.Contains(name, "..")
+}
+
+// Path of map key, keys with dots are quoted
+func keyPath(parent string, key string) string {
+	if strings.Contains(key, ".") {
+		return fmt.Sprintf("%s[%q]", parent, key)
+	}
+	return parent + "." + key
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
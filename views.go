@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"gopkg.in/yaml.v2"
+)
+
+// View serves clients from its networks with its own zones, forwarders
+// and static entries. Settings the view doesn't set are taken from the top level.
+type ViewConfig struct {
+	Clients    []string                   `yaml:"clients"`
+	Zones      Zones                      `yaml:"zones"`
+	Forwarders map[string]ForwarderConfig `yaml:"forwarders"`
+	Default    ForwarderConfig            `yaml:"default"`
+	Static     map[string]string          `yaml:"static"`
+}
+
+// View config with its name. Views keep the order of the config file, the first matching view wins
+type View struct {
+	Name string
+	ViewConfig
+}
+
+type Views []View
+
+// Views are decoded in the order they are listed in the config
+func (v *Views) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var order yaml.MapSlice
+	if err := unmarshal(&order); err != nil {
+		return err
+	}
+	var configs map[string]ViewConfig
+	if err := unmarshal(&configs); err != nil {
+		return err
+	}
+
+	*v = make(Views, 0, len(order))
+	for _, item := range order {
+		name := fmt.Sprint(item.Key)
+		*v = append(*v, View{Name: name, ViewConfig: configs[name]})
+	}
+	return nil
+}
+
+// Config of the view proxy: top level config with view settings over it
+func (c Config) viewConfig(view View) Config {
+	cfg := c
+	cfg.Views = nil
+	if view.Zones != nil {
+		cfg.Zones = view.Zones
+	}
+	if view.Forwarders != nil {
+		cfg.Forwarders = view.Forwarders
+	}
+	if len(view.Default.Upstreams) > 0 {
+		cfg.Default = view.Default
+	}
+	if view.Static != nil {
+		cfg.Static = view.Static
+	}
+	return cfg
+}
+
+// Proxy of a view with the networks of its clients
+type clientView struct {
+	name    string
+	clients []*net.IPNet
+	proxy   *DNSProxy
+}
+
+// Build proxies of views. They share the cache, answers are cached apart for each view
+func (proxy *DNSProxy) initViews(cfg Config) error {
+	for _, view := range cfg.Views {
+		clients, err := parseNetworks(view.Clients)
+		if err != nil {
+			return fmt.Errorf("view %s: %w", view.Name, err)
+		}
+		viewProxy, err := proxy.newViewProxy(cfg.viewConfig(view), view)
+		if err != nil {
+			return fmt.Errorf("view %s: %w", view.Name, err)
+		}
+		proxy.views = append(proxy.views, clientView{name: view.Name, clients: clients, proxy: viewProxy})
+	}
+	return nil
+}
+
+// Proxy of the view. Forwarders and zones the view doesn't set are the top level ones,
+// they are checked, watched and refreshed once. Prefetching is done by the top level proxy.
+func (proxy *DNSProxy) newViewProxy(cfg Config, view View) (*DNSProxy, error) {
+	viewProxy := newProxy(cfg, proxy.Cache)
+	viewProxy.view = view.Name
+	viewProxy.logger = proxy.logger
+	viewProxy.prefetchQueue = proxy.prefetchQueue
+	viewProxy.defaultForward = proxy.defaultForward
+	if len(view.Default.Upstreams) > 0 {
+		forwarder, err := NewForwarder(view.Default)
+		if err != nil {
+			return nil, fmt.Errorf("default forwarder: %w", err)
+		}
+		viewProxy.defaultForward = forwarder
+	}
+	viewProxy.forwarders = proxy.forwarders
+	if view.Forwarders != nil {
+		forwarders, err := newForwarders(view.Forwarders)
+		if err != nil {
+			viewProxy.Close()
+			return nil, err
+		}
+		viewProxy.forwarders = forwarders
+	}
+	if view.Zones == nil {
+		viewProxy.zoneIDs = proxy.zoneIDs
+		return viewProxy, nil
+	}
+	if err := viewProxy.initZones(cfg); err != nil {
+		viewProxy.Close()
+		return nil, err
+	}
+	return viewProxy, nil
+}
+
+// Proxy serving client: proxy of the first view the client belongs to,
+// clients outside of views are served by the top level one
+func (proxy *DNSProxy) forClient(client net.IP) *DNSProxy {
+	if client == nil {
+		return proxy
+	}
+	for _, view := range proxy.views {
+		for _, network := range view.clients {
+			if network.Contains(client) {
+				return view.proxy
+			}
+		}
+	}
+	return proxy
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseViews(t *testing.T) {
+	body := `
+zones:
+  default:
+    domains: ["."]
+    prefix: "300:dada:feda:f123:ff::"
+default: "8.8.8.8:53"
+static:
+  "test.com": "10.0.0.1"
+views:
+  yggdrasil:
+    clients: ["200::/7"]
+    default: "[308:84:68:55::]:53"
+  lan:
+    clients: ["192.168.0.0/16", "10.0.0.1"]
+    zones:
+      default:
+        domains: ["."]
+        return-public-ipv4: true
+    static: {}
+`
+	var cfg Config
+	if err := yaml.Unmarshal([]byte(body), &cfg); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	names := make([]string, 0, len(cfg.Views))
+	for _, view := range cfg.Views {
+		names = append(names, view.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"yggdrasil", "lan"}) {
+		t.Errorf("Views order = %v, want [yggdrasil lan]", names)
+	}
+
+	ygg := cfg.viewConfig(cfg.Views[0])
+	if !reflect.DeepEqual(ygg.Zones, cfg.Zones) || !reflect.DeepEqual(ygg.Static, cfg.Static) {
+		t.Errorf("View without zones and static doesn't inherit them: %+v", ygg)
+	}
+	if ygg.Default.Upstreams[0].Address != "[308:84:68:55::]:53" || ygg.Views != nil {
+		t.Errorf("View default forwarder = %+v", ygg.Default)
+	}
+	lan := cfg.viewConfig(cfg.Views[1])
+	if !lan.Zones.Get("default").ReturnPublicIPv4 || lan.Zones.Get("default").Prefix.IsSet() || len(lan.Static) != 0 {
+		t.Errorf("View zones and static are not its own: %+v", lan)
+	}
+	if lan.Default.Upstreams[0].Address != "8.8.8.8:53" {
+		t.Errorf("View without default forwarder doesn't inherit it: %+v", lan.Default)
+	}
+}
+
+func TestViews(t *testing.T) {
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 3600 IN A 10.0.0.1")
+			msg.Answer = append(msg.Answer, rr)
+		}
+		w.WriteMsg(msg)
+	}
+	_, serverAddr := startMockDNSServer(t, handler)
+
+	var cfg Config
+	body := `
+zones:
+  default:
+    domains: ["."]
+    prefix: "300:dada:feda:f123:ff::"
+views:
+  lan:
+    clients: ["192.168.0.0/16"]
+    zones:
+      default:
+        domains: ["."]
+        return-public-ipv4: true
+  local:
+    clients: ["127.0.0.0/8"]
+    zones:
+      local:
+        domains: ["local"]
+        return-public-ipv4: true
+`
+	if err := yaml.Unmarshal([]byte(body), &cfg); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	cfg.Default = ForwarderConfig{Upstreams: upstreamAddrs(serverAddr)}
+	proxy, err := NewDNSProxy(cfg, New(time.Minute, 0))
+	if err != nil {
+		t.Fatalf("NewDNSProxy() error = %v", err)
+	}
+	defer proxy.Close()
+
+	tests := []struct {
+		name     string
+		client   string
+		qname    string
+		qtype    uint16
+		rcode    int
+		expected []string
+	}{
+		{"Yggdrasil client gets NAT64 address", "300::1", "example.com.", dns.TypeAAAA, dns.RcodeSuccess, []string{"300:dada:feda:f123:ff:0:a00:1"}},
+		{"Yggdrasil client gets no IPv4", "300::1", "example.com.", dns.TypeA, dns.RcodeSuccess, nil},
+		{"LAN client gets public IPv4", "192.168.1.5", "example.com.", dns.TypeA, dns.RcodeSuccess, []string{"10.0.0.1"}},
+		{"LAN client doesn't get cached NAT64 address", "192.168.1.5", "example.com.", dns.TypeAAAA, dns.RcodeSuccess, nil},
+		{"Local client gets only its zones", "127.0.0.1", "example.com.", dns.TypeA, dns.RcodeNameError, nil},
+		{"Local client zone", "127.0.0.1", "printer.local.", dns.TypeA, dns.RcodeSuccess, []string{"10.0.0.1"}},
+		{"Unknown client gets top level zones", "", "example.com.", dns.TypeAAAA, dns.RcodeSuccess, []string{"300:dada:feda:f123:ff:0:a00:1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := new(dns.Msg)
+			query.SetQuestion(tt.qname, tt.qtype)
+			resp, err := proxy.getResponse(query, net.ParseIP(tt.client))
+			if err != nil {
+				t.Fatalf("getResponse() error = %v", err)
+			}
+			if resp.Rcode != tt.rcode {
+				t.Errorf("getResponse() rcode = %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			var answer []string
+			for _, rr := range resp.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					answer = append(answer, rr.A.String())
+				case *dns.AAAA:
+					answer = append(answer, rr.AAAA.String())
+				}
+			}
+			if !reflect.DeepEqual(answer, tt.expected) {
+				t.Errorf("getResponse() answer = %v, want %v", answer, tt.expected)
+			}
+		})
+	}
+}
+
+func TestViewsShareTopLevel(t *testing.T) {
+	body := `
+zones:
+  default:
+    domains: ["."]
+default: "127.0.0.1:1053"
+forwarders:
+  "lan.": "127.0.0.1:2053"
+views:
+  yggdrasil:
+    clients: ["200::/7"]
+    default: "127.0.0.1:3053"
+  lan:
+    clients: ["192.168.0.0/16"]
+    zones:
+      default:
+        domains: ["."]
+        return-public-ipv4: true
+`
+	var cfg Config
+	if err := yaml.Unmarshal([]byte(body), &cfg); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	proxy, err := NewDNSProxy(cfg, New(time.Minute, 0))
+	if err != nil {
+		t.Fatalf("NewDNSProxy() error = %v", err)
+	}
+	defer proxy.Close()
+
+	ygg, lan := proxy.views[0].proxy, proxy.views[1].proxy
+	if ygg.defaultForward == proxy.defaultForward || lan.defaultForward != proxy.defaultForward {
+		t.Errorf("View default forwarders are not shared with the top level unless set")
+	}
+	if ygg.forwarders != proxy.forwarders || lan.forwarders != proxy.forwarders {
+		t.Errorf("View forwarders are not shared with the top level")
+	}
+	if ygg.zoneIDs != proxy.zoneIDs || lan.zoneIDs == proxy.zoneIDs {
+		t.Errorf("View zones are not shared with the top level unless set")
+	}
+}